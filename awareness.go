@@ -21,13 +21,17 @@ type awareness struct {
 	// score is the current awareness score. Lower values are healthier and
 	// zero is the minimum value.
 	score int
+
+	// metricSink is where the score is reported.
+	metricSink metrics.MetricSink
 }
 
 // newAwareness returns a new awareness object.
-func newAwareness(max int) *awareness {
+func newAwareness(max int, sink metrics.MetricSink) *awareness {
 	return &awareness{
-		max:   max,
-		score: 0,
+		max:        max,
+		score:      0,
+		metricSink: sink,
 	}
 }
 
@@ -47,7 +51,7 @@ func (a *awareness) ApplyDelta(delta int) {
 	a.Unlock()
 
 	if initial != final {
-		metrics.SetGauge([]string{"memberlist", "health", "score"}, float32(final))
+		a.metricSink.SetGauge([]string{"memberlist", "health", "score"}, float32(final))
 	}
 }
 
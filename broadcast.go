@@ -1,5 +1,9 @@
 package memberlist
 
+import (
+	"time"
+)
+
 /*
 The broadcast mechanism works by maintaining a sorted list of messages to be
 sent out. When a message is to be broadcast, the retransmit count
@@ -50,6 +54,17 @@ func (m *Memberlist) encodeAndBroadcast(node string, msgType messageType, msg in
 // and notifies the given channel when transmission is finished. Fails
 // silently if there is an encoding error.
 func (m *Memberlist) encodeBroadcastNotify(node string, msgType messageType, msg interface{}, notify chan struct{}) {
+	// Give the filter a chance to suppress the broadcast. We still notify
+	// since anyone waiting on this has nothing left to wait for.
+	if m.config.BroadcastFilter != nil && !m.config.BroadcastFilter(int(msgType), node) {
+		m.metricSink().IncrCounter([]string{"memberlist", "broadcast", "suppressed"}, 1)
+		select {
+		case notify <- struct{}{}:
+		default:
+		}
+		return
+	}
+
 	buf, err := encode(msgType, msg)
 	if err != nil {
 		m.logger.Printf("[ERR] memberlist: Failed to encode message for broadcast: %s", err)
@@ -58,6 +73,70 @@ func (m *Memberlist) encodeBroadcastNotify(node string, msgType messageType, msg
 	}
 }
 
+// rebroadcast encodes a message that originated from the given node and
+// enqueues it for broadcast. If the message came from another node then it's
+// subject to MaxRebroadcastsPerSec, and will be dropped if we're over the
+// limit. This must be called while the nodeLock is held.
+func (m *Memberlist) rebroadcast(from string, node string, msgType messageType, msg interface{}, notify chan struct{}) {
+	if from != m.config.Name && !m.allowRebroadcast() {
+		m.metricSink().IncrCounter([]string{"memberlist", "broadcast", "throttled"}, 1)
+		select {
+		case notify <- struct{}{}:
+		default:
+		}
+		return
+	}
+	m.encodeBroadcastNotify(node, msgType, msg, notify)
+}
+
+// allowRebroadcast returns true if we are under MaxRebroadcastsPerSec, and
+// counts a re-broadcast against the limit if so. This must be called while
+// the nodeLock is held.
+func (m *Memberlist) allowRebroadcast() bool {
+	if m.config.MaxRebroadcastsPerSec <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	if now.Sub(m.rebroadcastStart) >= time.Second {
+		m.rebroadcastStart = now
+		m.rebroadcastCount = 0
+	}
+	if m.rebroadcastCount >= m.config.MaxRebroadcastsPerSec {
+		return false
+	}
+	m.rebroadcastCount++
+	return true
+}
+
+// metaUpdateWindow counts the meta data changes we've re-broadcast for a node
+// in the current one second window, see MaxMetaUpdatesPerNodePerSec.
+type metaUpdateWindow struct {
+	start time.Time
+	count int
+}
+
+// allowMetaUpdate returns true if we are under MaxMetaUpdatesPerNodePerSec
+// for the given node, and counts a re-broadcast of its meta data against the
+// limit if so. This must be called while the nodeLock is held.
+func (m *Memberlist) allowMetaUpdate(node string) bool {
+	if m.config.MaxMetaUpdatesPerNodePerSec <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	w, ok := m.metaUpdates[node]
+	if !ok || now.Sub(w.start) >= time.Second {
+		w = &metaUpdateWindow{start: now}
+		m.metaUpdates[node] = w
+	}
+	if w.count >= m.config.MaxMetaUpdatesPerNodePerSec {
+		return false
+	}
+	w.count++
+	return true
+}
+
 // queueBroadcast is used to start dissemination of a message. It will be
 // sent up to a configured number of times. The message could potentially
 // be invalidated by a future message about the same node
@@ -3,14 +3,33 @@ package memberlist
 import (
 	"io"
 	"log"
+	"net"
 	"os"
 	"time"
+
+	metrics "github.com/armon/go-metrics"
 )
 
 type Config struct {
 	// The name of this node. This must be unique in the cluster.
 	Name string
 
+	// NameGenerator is used to come up with a name for this node if Name is
+	// left empty, which is handy for ephemeral nodes in autoscaled fleets
+	// where it's hard to hand out unique names. If this is nil, the hostname
+	// with a random suffix is used. Note that generated names will change
+	// across restarts unless the generator is deterministic, so other nodes
+	// will see a restarted node as a brand new one, unless an ID is set.
+	NameGenerator func() string
+
+	// ID is an optional stable identity for this node, such as a UUID,
+	// that outlives the Name. If another node's Name changes across a
+	// restart but its ID stays the same, we treat it as a rename of the
+	// existing node instead of a brand new node. Since events are keyed
+	// by name, a rename is reported as the old name leaving followed by
+	// the new name joining. This must be unique in the cluster if set.
+	ID string
+
 	// Transport is a hook for providing custom code to communicate with
 	// other nodes. If this is left nil, then memberlist will by default
 	// make a NetTransport using BindAddr and BindPort from this structure.
@@ -28,6 +47,47 @@ type Config struct {
 	AdvertiseAddr string
 	AdvertisePort int
 
+	// AdvertiseAddrFunc, if set, lets the address we advertise depend on
+	// who we're telling, for clusters that span multiple networks. It's
+	// given the destination's IP and returns the IP we should advertise to
+	// it, or nil to use the regular advertise address.
+	//
+	// This is only consulted when we tell a peer about ourselves directly,
+	// which is during push/pull state exchanges, including joins, and when
+	// sending Refresh messages. Regular gossip is shared by everyone, so it
+	// always carries the regular advertise address. Since peers only accept
+	// the first address they learn for a node, and won't switch addresses
+	// later, this means a peer that learns about us second-hand via gossip
+	// before it has ever talked to us directly will keep the regular
+	// address. Use this only if every network can reach the regular
+	// advertise address, or if peers always join through a node in their
+	// own network.
+	AdvertiseAddrFunc func(dest net.IP) net.IP
+
+	// MaxInboundStreams is the maximum number of inbound stream connections,
+	// such as push/pulls from joining nodes, that we'll handle at once.
+	// Connections beyond this are closed right away. This protects a seed
+	// node from being overwhelmed when a large cluster bootstraps against
+	// it all at once. Setting this to zero disables the limit.
+	MaxInboundStreams int
+
+	// StreamKeepAlive is the TCP keep-alive period for stream connections,
+	// which are used for push/pulls and reliable messages. Stateful
+	// firewalls and NATs with aggressive idle timeouts can silently drop
+	// connections, and keep-alives stop that from happening while also
+	// detecting dead peers sooner. If this is zero, the OS and Go runtime
+	// defaults are used. This only applies to the default NetTransport.
+	StreamKeepAlive time.Duration
+
+	// ReceiveWorkers is the number of goroutines used to read and process
+	// incoming packets. Raising this above the default of one can help
+	// large clusters on machines with many cores, where a single goroutine
+	// can't keep up with the inbound packet rate. Packets may be processed
+	// out of order when this is more than one, which is fine since UDP
+	// makes no ordering guarantees anyway. If a custom Transport is given,
+	// this only applies to the processing side.
+	ReceiveWorkers int
+
 	// ProtocolVersion is the configured protocol version that we
 	// will _speak_. This must be between ProtocolVersionMin and
 	// ProtocolVersionMax.
@@ -47,6 +107,31 @@ type Config struct {
 	// at the expense of bandwidth.
 	IndirectChecks int
 
+	// NodeZone is an optional hook that returns the failure domain a node
+	// is in, such as an availability zone, usually taken from its meta
+	// data. When set, indirect probes prefer relays in a different zone
+	// than the node being probed, so a zone-wide problem on the target's
+	// side doesn't also cut off the relays. Relays from the same zone, or
+	// ones without a zone, are only used when there aren't enough others.
+	// This is called while holding internal locks, so it must not block or
+	// call back into memberlist.
+	NodeZone func(*Node) string
+
+	// CorroborateIndirectAcks makes indirect probes harder to satisfy. An
+	// ack relayed by a node that itself failed its last direct probe from
+	// us isn't trusted on its own, and needs a second relay to confirm the
+	// target is alive. This keeps a single flaky relay from masking a node
+	// that's really dead, at the cost of needing IndirectChecks of at least
+	// 2 to get any benefit from unreliable relays.
+	CorroborateIndirectAcks bool
+
+	// MaxPendingAcks bounds how many acks we'll wait on at once, across our
+	// own probes and pings and the indirect pings we relay for others. Once
+	// the limit is reached, new probes and pings fail right away until some
+	// of the outstanding ones are answered or time out. This keeps memory
+	// bounded when acks stop coming back. A zero value means no limit.
+	MaxPendingAcks int
+
 	// RetransmitMult is the multiplier for the number of retransmissions
 	// that are attempted for messages broadcasted over gossip. The actual
 	// count of retransmissions is calculated using the formula:
@@ -58,6 +143,14 @@ type Config struct {
 	// at the expense of increased bandwidth.
 	RetransmitMult int
 
+	// FixedRetransmits, if non-zero, is the exact number of retransmissions
+	// attempted for each message broadcasted over gossip, and RetransmitMult
+	// is ignored. This gives predictable dissemination that doesn't depend
+	// on the cluster size, which is mostly useful for small or fixed-size
+	// clusters. Keep in mind that the count no longer grows as the cluster
+	// does, so messages are less likely to converge in large clusters.
+	FixedRetransmits int
+
 	// SuspicionMult is the multiplier for determining the time an
 	// inaccessible node is considered suspect before declaring it dead.
 	// The actual timeout is calculated using the formula:
@@ -98,6 +191,29 @@ type Config struct {
 	// usage.
 	PushPullInterval time.Duration
 
+	// MaxPushPullNodes, if non-zero, caps the number of nodes sent in each
+	// periodic push/pull. When we know about more nodes than this, a random
+	// sample of them is sent instead, always including ourselves, so the
+	// full state is still covered over several rounds. This bounds the cost
+	// of each exchange in very large clusters. The full state is always
+	// sent when joining.
+	MaxPushPullNodes int
+
+	// PushPullExcludeFunc is an optional hook that keeps nodes from being
+	// picked as partners for the periodic push/pull. Returning true for a
+	// node means we'll never start a state exchange with it, such as for
+	// read-only observers that don't need the full state. Excluded nodes
+	// still get gossip and are probed as usual. This is called while
+	// holding internal locks, so it must not block or call back into
+	// memberlist.
+	PushPullExcludeFunc func(*Node) bool
+
+	// RoundRobinPushPull picks push/pull partners in rotation, the same way
+	// nodes are picked for probing, instead of at random. This guarantees
+	// every node is synced with within a bounded number of rounds, which
+	// improves the worst case for anti-entropy in large clusters.
+	RoundRobinPushPull bool
+
 	// ProbeInterval and ProbeTimeout are used to configure probing
 	// behavior for memberlist.
 	//
@@ -111,6 +227,20 @@ type Config struct {
 	ProbeInterval time.Duration
 	ProbeTimeout  time.Duration
 
+	// ProbeConcurrency is how many nodes are probed in parallel each
+	// ProbeInterval, taking the next ones in the rotation. Raising this
+	// shortens the time it takes to get around a large cluster, so failures
+	// are detected sooner, at the cost of more probe traffic. Values below
+	// 1 are treated as 1.
+	ProbeConcurrency int
+
+	// NewNodeGracePeriod gives nodes that only recently became alive, such
+	// as ones that just joined, extra slack to answer probes while their
+	// network paths are still warming up. Nodes that became alive within
+	// this period get twice the usual ProbeTimeout and ProbeInterval to ack
+	// before we suspect them. Setting this to zero disables the grace period.
+	NewNodeGracePeriod time.Duration
+
 	// DisableTcpPings will turn off the fallback TCP pings that are attempted
 	// if the direct UDP ping fails. These get pipelined along with the
 	// indirect UDP pings.
@@ -121,6 +251,86 @@ type Config struct {
 	// time requirements to reliably probe other nodes.
 	AwarenessMaxMultiplier int
 
+	// OnProbe is an optional callback invoked with the node that is about
+	// to be probed, once per probe round. It is called outside of the node
+	// lock and before the ping is sent, which makes it useful to observe
+	// the decisions of the failure detector. It must not block.
+	OnProbe func(node *Node)
+
+	// OnProbeSkip is an optional debugging callback invoked for each node
+	// the probe rotation passes over without probing, along with the reason,
+	// which is one of "self", "dead", or "other-class" for nodes that are
+	// probed in the other one of the LAN and WAN rotations. This can be used
+	// to audit probe coverage when failure detection is unexpectedly slow.
+	// Leave this unset in production, since it's called for every node on
+	// every pass. It is called outside of the node lock, and must not block.
+	OnProbeSkip func(node *Node, reason string)
+
+	// IsolationTimeout and OnIsolated are used to signal the application
+	// when this node has no live peers, which would otherwise look just like
+	// a healthy node that was started on its own.
+	//
+	// IsolationTimeout is how long the node must go without any live peers
+	// before it's considered isolated. Setting this to zero disables the
+	// isolation check.
+	//
+	// OnIsolated is invoked every IsolationTimeout for as long as the node
+	// remains isolated. It must not block.
+	IsolationTimeout time.Duration
+	OnIsolated       func()
+
+	// ReseedOnIsolation enables automatic recovery after the node has been
+	// isolated for IsolationTimeout, by retrying a Join against ReseedNodes,
+	// or against the hosts given to the last successful Join if ReseedNodes
+	// is empty, or against the SnapshotPath if there are none of those
+	// either. Failed attempts back off exponentially, starting from
+	// IsolationTimeout and doubling up to ReseedMaxBackoff. If
+	// ReseedMaxBackoff is zero the backoff is not bounded.
+	ReseedOnIsolation bool
+	ReseedNodes       []string
+	ReseedMaxBackoff  time.Duration
+
+	// SnapshotPath and SnapshotInterval are used to persist the membership
+	// so a restarting node can find its way back into the cluster without
+	// any external seed discovery.
+	//
+	// SnapshotPath is the file where the addresses of the live members are
+	// saved. If this is set, calling Join with no hosts joins using the
+	// addresses saved in this file instead. The snapshot isn't overwritten
+	// while there are no other live members, so it keeps the last members
+	// we knew about.
+	//
+	// SnapshotInterval is how often the snapshot is written. Setting this
+	// to zero disables writing snapshots. Snapshots are written to a
+	// temporary file first and then renamed into place, so a crash in the
+	// middle of a write never leaves a corrupt snapshot behind.
+	SnapshotPath     string
+	SnapshotInterval time.Duration
+
+	// SelfCheckInterval is how often we verify that our internal node list
+	// and node map agree with each other. This is a safety net that catches
+	// state corruption bugs before they lead to missed probes or worse. Any
+	// problems found are logged and passed to OnInconsistency, if set.
+	// Setting this to zero disables the check.
+	SelfCheckInterval time.Duration
+
+	// OnInconsistency is called with a description of each problem found
+	// by the SelfCheckInterval check. It must not block.
+	OnInconsistency func(problems []string)
+
+	// OnSizeChange, if set, is called with the old and new number of live
+	// members when the cluster size changes significantly, which is handy
+	// for driving things like shard rebalancing off of membership. Changes
+	// are collected over SizeChangeWindow before being checked, so a burst
+	// of joins or leaves is reported once. A change is significant if it's
+	// at least SizeChangePercent of the last reported size, or if it crosses
+	// any of the SizeChangeThresholds. If neither of those is set, any
+	// change is reported. This is called from its own goroutine.
+	OnSizeChange         func(old, new int)
+	SizeChangeWindow     time.Duration
+	SizeChangePercent    float64
+	SizeChangeThresholds []int
+
 	// GossipInterval and GossipNodes are used to configure the gossip
 	// behavior of memberlist.
 	//
@@ -141,6 +351,127 @@ type Config struct {
 	GossipNodes         int
 	GossipToTheDeadTime time.Duration
 
+	// GossipDownNodes is how many suspect or recently dead nodes to repeat
+	// the state of in each gossip message, space permitting. Normally
+	// these only go out when the state changes, so a node that joins
+	// afterwards won't hear about them until its next push/pull. Dead nodes
+	// are included for GossipToTheDeadTime after they die. If this is zero,
+	// no extra states are sent.
+	GossipDownNodes int
+
+	// MaxGossipNodes lets the gossip fan-out grow beyond GossipNodes when
+	// the broadcast queue backs up, which is a sign that we are struggling
+	// to keep up with the rate of changes in the cluster. One extra node is
+	// added for every gossipBackpressureDepth queued broadcasts, up to this
+	// many nodes in total, and the fan-out drops back down as the queue
+	// drains. If this is not greater than GossipNodes, the fan-out is fixed.
+	MaxGossipNodes int
+
+	// GossipMult, if set, scales the gossip fan-out with the size of the
+	// cluster, so that messages take about the same number of rounds to
+	// spread no matter how big it gets. The fan-out is computed each round
+	// as:
+	//
+	//   Fanout = GossipMult * log(N+1)
+	//
+	// GossipNodes acts as the floor, and MaxGossipNodes as the ceiling if
+	// it's greater than GossipNodes. If this is zero, GossipNodes is used
+	// as is.
+	GossipMult int
+
+	// WANCIDRs, WANProbeInterval, and WANGossipInterval are used to give
+	// remote peers their own, usually slower, probe and gossip cadence in
+	// a hybrid cluster.
+	//
+	// WANCIDRs is the list of networks whose peers are considered WAN
+	// peers. Peers outside of these networks are considered LAN peers.
+	//
+	// WANProbeInterval is the interval between probes of WAN peers. If
+	// this is zero, WAN peers are probed along with everyone else every
+	// ProbeInterval. Otherwise they are excluded from the regular probe
+	// rotation and probed in their own rotation.
+	//
+	// WANGossipInterval is the interval between gossip rounds sent to WAN
+	// peers, each of which picks GossipNodes of them. If this is zero, WAN
+	// peers are gossiped to along with everyone else every GossipInterval.
+	WANCIDRs          []*net.IPNet
+	WANProbeInterval  time.Duration
+	WANGossipInterval time.Duration
+
+	// ReapLimit and ReapComparator control how dead nodes are evicted from
+	// the node table once GossipToTheDeadTime has passed.
+	//
+	// ReapLimit is the maximum number of dead nodes to reap each time we
+	// go around the probe rotation. Any others are kept until a later
+	// rotation. If this is zero, all eligible dead nodes are reaped at once.
+	//
+	// ReapComparator, if set, orders the dead nodes eligible for reaping
+	// and should return true if a should be reaped before b. Nodes it ranks
+	// lower are kept longer when ReapLimit applies, which can be used to
+	// hold on to nodes that are expected to return, like seed nodes.
+	ReapLimit      int
+	ReapComparator func(a, b *Node) bool
+
+	// BroadcastFilter is an optional hook consulted before we queue a
+	// membership message (alive, suspect, or dead) about the given node for
+	// gossip. Returning false suppresses the broadcast, which can be used to
+	// implement custom dampening policies, such as not spreading suspicions
+	// about a node that is known to be flaky. The msgType is the wire type of
+	// the message. This is called while holding internal locks, so it must
+	// not block or call back into memberlist.
+	BroadcastFilter func(msgType int, node string) bool
+
+	// IncarnationComparator, if set, replaces the plain numeric ordering
+	// of incarnation numbers when deciding whether an alive, suspect, or
+	// dead message is newer than what we know about a node. It should
+	// return a negative number if a is older than b, 0 if they are the
+	// same, and a positive number if a is newer. This allows incarnations
+	// to carry logical clocks or hybrid timestamps. Note that nodes still
+	// refute by bumping their incarnation by one, so the comparator must
+	// treat a+1 as newer than a. This is called while holding internal
+	// locks, so it must not block or call back into memberlist.
+	IncarnationComparator func(a, b uint32) int
+
+	// MaxRebroadcastsPerSec caps how many alive, suspect, and dead messages
+	// learned from other nodes we'll queue up to re-gossip each second. Each
+	// incoming update is normally re-broadcast, which can amplify traffic
+	// badly during cascading failures. Once the cap is hit, updates are still
+	// applied locally but aren't re-broadcast, and other nodes will pick them
+	// up from the messages already in flight or via push/pull. Messages we
+	// originate ourselves, such as refutes, are never throttled. If this is
+	// 0, re-broadcasts aren't limited.
+	MaxRebroadcastsPerSec int
+
+	// MaxMetaUpdatesPerNodePerSec caps how many meta data changes for any
+	// single other node we'll re-broadcast each second. This keeps a node
+	// that's updating its meta data in a tight loop from flooding the
+	// cluster. Updates over the limit are still applied locally, but aren't
+	// re-broadcast. If this is 0, meta data changes aren't limited.
+	MaxMetaUpdatesPerNodePerSec int
+
+	// ConfirmBeforeAdd controls whether nodes we hear about second-hand are
+	// confirmed before they are added to the member list. When set, an alive
+	// message about a node we don't know yet holds the node in a pending set
+	// while we send it a direct ping, and it only becomes a member once it
+	// answers. Nodes that don't answer within the ProbeTimeout are dropped.
+	// This keeps phantom nodes advertised by a single misinformed peer from
+	// showing up in Members, at the cost of slower joins.
+	ConfirmBeforeAdd bool
+
+	// ReviveOnContact speeds up the recovery of nodes we've wrongly marked
+	// dead. When set, receiving a packet from a node we think is dead makes
+	// us ping it, and if it answers, we tell it directly that we think it's
+	// dead, so it can refute that right away instead of waiting for the
+	// news to reach it via gossip.
+	ReviveOnContact bool
+
+	// InitialMembers seeds the member list when it's created by Create, so
+	// that probing and gossip can start right away against a known, static
+	// set of nodes without needing a Join. Each of these is added as alive
+	// with an incarnation of 1. If a node's protocol versions aren't set then
+	// they are assumed to match ours. Any entry with our own name is ignored.
+	InitialMembers []Node
+
 	// GossipVerifyIncoming controls whether to enforce encryption for incoming
 	// gossip. It is used for upshifting from unencrypted to encrypted gossip on
 	// a running cluster.
@@ -187,10 +518,77 @@ type Config struct {
 	Ping                    PingDelegate
 	Alive                   AliveDelegate
 
+	// TraceProbes records every step of each probe, from the direct ping
+	// through the indirect pings to the suspicion, which is useful for
+	// diagnosing why a healthy node was suspected. Finished traces are sent
+	// on ProbeTraceCh if it's set, and are otherwise logged at the DEBUG
+	// level. Traces are dropped if the channel is full, so that probing is
+	// never held up.
+	TraceProbes  bool
+	ProbeTraceCh chan<- *ProbeTrace
+
+	// LeaveBatchWindow and LeaveBatchCh are used to deliver node failures in
+	// batches, so that an application can react to a mass failure, such as a
+	// network partition, as a single unit rather than once per node.
+	//
+	// When LeaveBatchCh is set, every node marked dead is collected for
+	// LeaveBatchWindow after the first one, and then the whole batch is sent
+	// on the channel. The Events delegate is still notified about each node
+	// individually. Care must be taken that batches are processed in a timely
+	// manner, since the next batch will block until this one is received.
+	LeaveBatchWindow time.Duration
+	LeaveBatchCh     chan<- []*Node
+
+	// ExcludeSuspectFromMembers leaves suspect nodes out of Members and
+	// NumMembers, so that applications routing traffic based on those stop
+	// using a node as soon as it's suspected, instead of waiting for it to
+	// be declared dead. This doesn't change failure detection at all, and a
+	// suspect node that refutes shows up again right away.
+	ExcludeSuspectFromMembers bool
+
+	// LeaveGrace, if non-zero, defers telling the application that a node
+	// has left, via the Events delegate or the LeaveBatchCh, until the node
+	// has been dead for this long. If the node comes back within the grace
+	// period then neither the leave nor the join is announced, so brief
+	// blips don't cause the application to react, such as by re-sharding.
+	// The node is still considered dead internally during this time.
+	LeaveGrace time.Duration
+
+	// EventWriter, if set, receives a structured stream of membership
+	// events, one JSON object per line. Events are written for joins,
+	// leaves, suspicions, deaths, refutations, and failed probes, and carry
+	// the time, node name, address, and incarnation number. Writes are
+	// serialized internally, and are done inline so the writer should be
+	// fast, like a buffered file or a pipe.
+	EventWriter io.Writer
+
 	// DNSConfigPath points to the system's DNS config file, usually located
 	// at /etc/resolv.conf. It can be overridden via config for easier testing.
 	DNSConfigPath string
 
+	// RandSeed, if non-zero, seeds the random number generator used for
+	// the probe order, gossip and push/pull targets, indirect probe relays,
+	// and timer staggers. This makes those choices reproducible, which is
+	// useful in tests. If this is zero, a random seed is used.
+	//
+	// Once the memberlist is scheduled, the probe, gossip and push/pull
+	// goroutines all draw from the same generator as they run, so only the
+	// staggers are reproducible from then on. Tests that need reproducible
+	// target choices should drive an unscheduled memberlist by hand.
+	RandSeed int64
+
+	// PreferIPv6 orders the addresses a join target's host name resolves to
+	// so that IPv6 addresses are tried before IPv4 ones. This is useful for
+	// IPv6-only clusters whose DNS names still carry A records.
+	PreferIPv6 bool
+
+	// MetricSink is where metrics are sent. If this is nil, they go to the
+	// global go-metrics sink, which is shared by everything in the process.
+	// Give each memberlist its own sink to tell them apart when running more
+	// than one in a process. This is also passed on to the default
+	// NetTransport.
+	MetricSink metrics.MetricSink
+
 	// LogOutput is the writer where logs should be sent. If this is not
 	// set, logging will go to stderr by default. You cannot specify both LogOutput
 	// and Logger at the same time.
@@ -215,6 +613,14 @@ type Config struct {
 	// This is a legacy name for backward compatibility but should really be
 	// called PacketBufferSize now that we have generalized the transport.
 	UDPBufferSize int
+
+	// ChaosDelayFunc is meant for chaos testing only, and should never be
+	// set in production. If set, it's called with the destination of every
+	// packet we send, such as probes, acks, and gossip, and the packet is
+	// held back for the returned duration before going out, which simulates
+	// a slow link to that peer. Sending doesn't block while a packet is held
+	// back. Returning zero sends the packet right away.
+	ChaosDelayFunc func(dest net.IP) time.Duration
 }
 
 // DefaultLANConfig returns a sane set of configurations for Memberlist.
@@ -242,6 +648,7 @@ func DefaultLANConfig() *Config {
 		ProbeInterval:           1 * time.Second,        // Failure check every second
 		DisableTcpPings:         false,                  // TCP pings are safe, even with mixed versions
 		AwarenessMaxMultiplier:  8,                      // Probe interval backs off to 8 seconds
+		ReseedMaxBackoff:        5 * time.Minute,        // Keep trying to reseed at least every 5 minutes
 
 		GossipNodes:          3,                      // Gossip to 3 nodes
 		GossipInterval:       200 * time.Millisecond, // Gossip more rapidly
@@ -24,7 +24,11 @@ type EventDelegate interface {
 // function call.
 //
 // Care must be taken that events are processed in a timely manner from
-// the channel, since this delegate will block until an event can be sent.
+// the channel, since this delegate will block until an event can be sent,
+// and that holds up the handling of membership messages. Consumers that
+// may fall behind should use Memberlist.Subscribe instead, which gives
+// each subscriber a buffered channel and drops events for them rather
+// than blocking.
 type ChannelEventDelegate struct {
 	Ch chan<- NodeEvent
 }
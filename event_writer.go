@@ -0,0 +1,52 @@
+package memberlist
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Event names written to the Config.EventWriter.
+const (
+	eventJoin      = "join"
+	eventLeave     = "leave"
+	eventSuspect   = "suspect"
+	eventDead      = "dead"
+	eventRefute    = "refute"
+	eventProbeFail = "probe-fail"
+)
+
+// eventRecord is a single line written to the Config.EventWriter.
+type eventRecord struct {
+	Time        time.Time `json:"time"`
+	Event       string    `json:"event"`
+	Node        string    `json:"node"`
+	Addr        string    `json:"addr"`
+	Incarnation uint32    `json:"incarnation"`
+}
+
+// writeEvent writes an event about the given node to the EventWriter, if one
+// is configured.
+func (m *Memberlist) writeEvent(event string, node *Node, incarnation uint32) {
+	if m.config.EventWriter == nil {
+		return
+	}
+
+	buf, err := json.Marshal(&eventRecord{
+		Time:        time.Now(),
+		Event:       event,
+		Node:        node.Name,
+		Addr:        node.Address(),
+		Incarnation: incarnation,
+	})
+	if err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to encode %s event: %v", event, err)
+		return
+	}
+	buf = append(buf, '\n')
+
+	m.eventWriterLock.Lock()
+	defer m.eventWriterLock.Unlock()
+	if _, err := m.config.EventWriter.Write(buf); err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to write %s event: %v", event, err)
+	}
+}
@@ -0,0 +1,50 @@
+package memberlist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestMemberlist_EventWriter(t *testing.T) {
+	var buf bytes.Buffer
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	m.config.EventWriter = &buf
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1}
+	m.aliveNode(&a, nil, false)
+	s := suspect{Node: "test", Incarnation: 1}
+	m.suspectNode(&s)
+	d := dead{Node: "test", Incarnation: 2}
+	m.deadNode(&d)
+
+	a = alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 3}
+	m.aliveNode(&a, nil, false)
+	d = dead{Node: "test", From: "test", Incarnation: 3}
+	m.deadNode(&d)
+
+	var events []string
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var rec eventRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if rec.Node != "test" || rec.Addr != "127.0.0.1:7946" || rec.Time.IsZero() {
+			t.Fatalf("bad: %#v", rec)
+		}
+		events = append(events, rec.Event)
+	}
+
+	expected := []string{eventJoin, eventSuspect, eventDead, eventJoin, eventLeave}
+	if len(events) != len(expected) {
+		t.Fatalf("bad: %v", events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Fatalf("bad: %v", events)
+		}
+	}
+}
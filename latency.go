@@ -0,0 +1,94 @@
+package memberlist
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencySamples is the number of recent samples we keep around in order
+// to estimate latency percentiles.
+const latencySamples = 1024
+
+// latencyWindow keeps a fixed-size window of the most recent duration
+// samples, which is used to compute percentiles on demand. This is cheap to
+// update from the probe path, and since percentiles are only requested
+// occasionally by operators we can afford to sort a copy when they are.
+type latencyWindow struct {
+	sync.Mutex
+
+	// samples is a ring buffer of the most recent samples and next is the
+	// index where the next sample will be written.
+	samples []time.Duration
+	next    int
+}
+
+// newLatencyWindow returns a window that holds up to size samples.
+func newLatencyWindow(size int) *latencyWindow {
+	return &latencyWindow{
+		samples: make([]time.Duration, 0, size),
+	}
+}
+
+// Add records a new sample, evicting the oldest one if the window is full.
+func (l *latencyWindow) Add(d time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	if len(l.samples) < cap(l.samples) {
+		l.samples = append(l.samples, d)
+		return
+	}
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % len(l.samples)
+}
+
+// Percentiles returns the value at each of the given percentiles, which must
+// be in the range (0, 100]. This returns nil if there are no samples yet.
+func (l *latencyWindow) Percentiles(ps ...float64) []time.Duration {
+	l.Lock()
+	sorted := make([]time.Duration, len(l.samples))
+	copy(sorted, l.samples)
+	l.Unlock()
+
+	if len(sorted) == 0 {
+		return nil
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	out := make([]time.Duration, len(ps))
+	for i, p := range ps {
+		// Use the nearest-rank method.
+		rank := int(p/100.0*float64(len(sorted))+0.5) - 1
+		if rank < 0 {
+			rank = 0
+		} else if rank >= len(sorted) {
+			rank = len(sorted) - 1
+		}
+		out[i] = sorted[rank]
+	}
+	return out
+}
+
+// LatencyPercentiles returns the p50, p95, and p99 estimates of the direct
+// probe round-trip time and of the time it took to detect failed nodes,
+// based on recent history. Failure detection time is measured from when we
+// first suspected a node until we declared it dead. The keys are of the form
+// "rtt-p50" and "detect-p99", and are only present once there are samples
+// for them.
+func (m *Memberlist) LatencyPercentiles() map[string]time.Duration {
+	out := make(map[string]time.Duration)
+	for prefix, l := range map[string]*latencyWindow{
+		"rtt":    m.probeRTTs,
+		"detect": m.detectTimes,
+	} {
+		ds := l.Percentiles(50, 95, 99)
+		if ds == nil {
+			continue
+		}
+		out[prefix+"-p50"] = ds[0]
+		out[prefix+"-p95"] = ds[1]
+		out[prefix+"-p99"] = ds[2]
+	}
+	return out
+}
@@ -0,0 +1,43 @@
+package memberlist
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyWindow_Percentiles(t *testing.T) {
+	l := newLatencyWindow(100)
+	if ps := l.Percentiles(50); ps != nil {
+		t.Fatalf("bad: %v", ps)
+	}
+
+	for i := 100; i > 0; i-- {
+		l.Add(time.Duration(i) * time.Millisecond)
+	}
+
+	ps := l.Percentiles(50, 95, 99, 100)
+	expected := []time.Duration{
+		50 * time.Millisecond,
+		95 * time.Millisecond,
+		99 * time.Millisecond,
+		100 * time.Millisecond,
+	}
+	for i := range expected {
+		if ps[i] != expected[i] {
+			t.Fatalf("bad: %v", ps)
+		}
+	}
+}
+
+func TestLatencyWindow_Evict(t *testing.T) {
+	l := newLatencyWindow(4)
+	for i := 1; i <= 6; i++ {
+		l.Add(time.Duration(i) * time.Second)
+	}
+
+	// Only the four most recent samples should remain.
+	ps := l.Percentiles(1, 100)
+	if ps[0] != 3*time.Second || ps[1] != 6*time.Second {
+		t.Fatalf("bad: %v", ps)
+	}
+}
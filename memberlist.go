@@ -15,11 +15,15 @@ multiple routes.
 package memberlist
 
 import (
+	"bytes"
 	"container/list"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -31,12 +35,21 @@ import (
 	"github.com/miekg/dns"
 )
 
+// ErrNameConflict is returned by Join when another alive node in the cluster
+// is already using our name, which is usually a sign of misconfiguration.
+var ErrNameConflict = errors.New("Another node is already using this name")
+
+// joinWaitInterval is how often JoinAndWait checks the number of members.
+const joinWaitInterval = 50 * time.Millisecond
+
 type Memberlist struct {
 	sequenceNum uint32 // Local sequence number
 	incarnation uint32 // Local incarnation number
 	numNodes    uint32 // Number of known nodes (estimate)
 	pushPullReq uint32 // Number of push/pull requests
 
+	lastGossipFanout int32 // Number of nodes picked for the last gossip round
+
 	config         *Config
 	shutdown       int32 // Used as an atomic boolean value
 	shutdownCh     chan struct{}
@@ -56,19 +69,84 @@ type Memberlist struct {
 	nodeLock   sync.RWMutex
 	nodes      []*nodeState          // Known nodes
 	nodeMap    map[string]*nodeState // Maps Addr.String() -> NodeState
+	nodeIDs    map[string]*nodeState // Maps Node.ID -> NodeState, if set
 	nodeTimers map[string]*suspicion // Maps Addr.String() -> suspicion timer
 	awareness  *awareness
 
-	tickerLock sync.Mutex
-	tickers    []*time.Ticker
-	stopTick   chan struct{}
-	probeIndex int
+	// Deferred leave notifications, see LeaveGrace. Guarded by nodeLock.
+	leaveTimers map[string]*time.Timer
+
+	// Re-broadcasts queued in the current one second window, see
+	// MaxRebroadcastsPerSec. Guarded by nodeLock.
+	rebroadcastStart time.Time
+	rebroadcastCount int
+
+	// Highest incarnation seen in an alive message about ourselves. Guarded
+	// by nodeLock.
+	selfIncarnationSeen uint32
+
+	// Random number generator for all of our random choices, like probe
+	// order and gossip targets. See RandSeed.
+	rng *rand.Rand
+
+	// Meta data re-broadcasts per node in the current one second window,
+	// see MaxMetaUpdatesPerNodePerSec. Guarded by nodeLock.
+	metaUpdates map[string]*metaUpdateWindow
+
+	// Maps Addr.String() -> name of dead nodes, when ReviveOnContact is
+	// set. Guarded by nodeLock.
+	deadAddrs map[string]string
+
+	reviveLock sync.Mutex
+	reviving   map[string]struct{} // Dead nodes we are trying to revive
+
+	tickerLock    sync.Mutex
+	tickers       []*time.Ticker
+	stopTick      chan struct{}
+	probeIndex    int
+	wanProbeIndex int
+	pushPullIndex int       // Only accessed by the push/pull ticker
+	aloneSince    time.Time // Only accessed by the isolation ticker
+
+	// These are only accessed by the isolation ticker
+	reseedBackoff time.Duration
+	nextReseed    time.Time
+
+	joinLock  sync.Mutex
+	joinNodes []string // Hosts given to the last successful Join
 
 	ackLock     sync.Mutex
 	ackHandlers map[uint32]*ackHandler
 
 	broadcasts *TransmitLimitedQueue
 
+	probeRTTs   *latencyWindow
+	detectTimes *latencyWindow
+
+	leaveBatchLock sync.Mutex
+	leaveBatch     []*Node
+
+	eventWriterLock sync.Mutex
+
+	subscribersLock  sync.Mutex
+	subscribers      map[int]chan NodeEvent
+	nextSubscriberID int
+
+	pendingLock  sync.Mutex
+	pendingNodes map[string]*pendingNode // Nodes waiting to be confirmed
+
+	inboundStreams chan struct{} // Semaphore for MaxInboundStreams, if set
+
+	gossipFailLock  sync.Mutex
+	gossipFailTimes map[string]time.Time // Last gossip send failure per node
+
+	probeMissLock sync.Mutex
+	probeMisses   map[string]int // Consecutive failed direct probes per node
+
+	sizeLock  sync.Mutex
+	sizeTimer *time.Timer // Pending check for OnSizeChange
+	lastSize  int         // Size last reported to OnSizeChange
+
 	logger *log.Logger
 }
 
@@ -83,6 +161,17 @@ func newMemberlist(conf *Config) (*Memberlist, error) {
 			conf.ProtocolVersion, ProtocolVersionMin, ProtocolVersionMax)
 	}
 
+	if conf.Name == "" {
+		if conf.NameGenerator != nil {
+			conf.Name = conf.NameGenerator()
+		} else {
+			conf.Name = generateName()
+		}
+		if conf.Name == "" {
+			return nil, fmt.Errorf("Node name is empty and none could be generated")
+		}
+	}
+
 	if len(conf.SecretKey) > 0 {
 		if conf.Keyring == nil {
 			keyring, err := NewKeyring(nil, conf.SecretKey)
@@ -119,9 +208,12 @@ func newMemberlist(conf *Config) (*Memberlist, error) {
 	transport := conf.Transport
 	if transport == nil {
 		nc := &NetTransportConfig{
-			BindAddrs: []string{conf.BindAddr},
-			BindPort:  conf.BindPort,
-			Logger:    logger,
+			BindAddrs:       []string{conf.BindAddr},
+			BindPort:        conf.BindPort,
+			Logger:          logger,
+			ReceiveWorkers:  conf.ReceiveWorkers,
+			StreamKeepAlive: conf.StreamKeepAlive,
+			MetricSink:      conf.MetricSink,
 		}
 
 		// See comment below for details about the retry in here.
@@ -174,17 +266,40 @@ func newMemberlist(conf *Config) (*Memberlist, error) {
 		highPriorityMsgQueue: list.New(),
 		lowPriorityMsgQueue:  list.New(),
 		nodeMap:              make(map[string]*nodeState),
+		nodeIDs:              make(map[string]*nodeState),
+		leaveTimers:          make(map[string]*time.Timer),
+		deadAddrs:            make(map[string]string),
+		metaUpdates:          make(map[string]*metaUpdateWindow),
+		rng:                  newRand(conf.RandSeed),
+		reviving:             make(map[string]struct{}),
 		nodeTimers:           make(map[string]*suspicion),
-		awareness:            newAwareness(conf.AwarenessMaxMultiplier),
+		pendingNodes:         make(map[string]*pendingNode),
+		gossipFailTimes:      make(map[string]time.Time),
+		probeMisses:          make(map[string]int),
+		lastSize:             1,
+		subscribers:          make(map[int]chan NodeEvent),
+		awareness:            newAwareness(conf.AwarenessMaxMultiplier, metricSinkOrGlobal(conf.MetricSink)),
 		ackHandlers:          make(map[uint32]*ackHandler),
-		broadcasts:           &TransmitLimitedQueue{RetransmitMult: conf.RetransmitMult},
+		broadcasts:           &TransmitLimitedQueue{RetransmitMult: conf.RetransmitMult, FixedRetransmits: conf.FixedRetransmits},
+		lastGossipFanout:     int32(conf.GossipNodes),
+		probeRTTs:            newLatencyWindow(latencySamples),
+		detectTimes:          newLatencyWindow(latencySamples),
 		logger:               logger,
 	}
 	m.broadcasts.NumNodes = func() int {
 		return m.estNumNodes()
 	}
+	if conf.MaxInboundStreams > 0 {
+		m.inboundStreams = make(chan struct{}, conf.MaxInboundStreams)
+	}
 	go m.streamListen()
-	go m.packetListen()
+	workers := conf.ReceiveWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go m.packetListen()
+	}
 	go m.packetHandler()
 	return m, nil
 }
@@ -203,6 +318,7 @@ func Create(conf *Config) (*Memberlist, error) {
 		m.Shutdown()
 		return nil, err
 	}
+	m.addInitialMembers()
 	m.schedule()
 	return m, nil
 }
@@ -215,8 +331,24 @@ func Create(conf *Config) (*Memberlist, error) {
 //
 // This returns the number of hosts successfully contacted and an error if
 // none could be reached. If an error is returned, the node did not successfully
-// join the cluster.
+// join the cluster. If another alive node in the cluster is already using our
+// name, and there's no Conflict delegate to handle that, this gives up right
+// away with ErrNameConflict.
+//
+// If no hosts are given and a SnapshotPath is configured, the hosts saved in
+// the last snapshot are used instead.
 func (m *Memberlist) Join(existing []string) (int, error) {
+	if len(existing) == 0 && m.config.SnapshotPath != "" {
+		hosts, err := readSnapshot(m.config.SnapshotPath)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to read snapshot: %v", err)
+		}
+		if len(hosts) == 0 {
+			return 0, fmt.Errorf("No hosts in snapshot %s", m.config.SnapshotPath)
+		}
+		existing = hosts
+	}
+
 	numSuccess := 0
 	var errs error
 	for _, exist := range existing {
@@ -231,6 +363,13 @@ func (m *Memberlist) Join(existing []string) (int, error) {
 		for _, addr := range addrs {
 			hp := joinHostPort(addr.ip.String(), addr.port)
 			if err := m.pushPullNode(hp, true); err != nil {
+				// There's no point in trying anyone else since
+				// they will all know about the other node.
+				if err == ErrNameConflict {
+					m.logger.Printf("[ERR] memberlist: Another node is using our name %s", m.config.Name)
+					return 0, err
+				}
+
 				err = fmt.Errorf("Failed to join %s: %v", addr.ip, err)
 				errs = multierror.Append(errs, err)
 				m.logger.Printf("[DEBUG] memberlist: %v", err)
@@ -242,10 +381,47 @@ func (m *Memberlist) Join(existing []string) (int, error) {
 	}
 	if numSuccess > 0 {
 		errs = nil
+
+		// Remember who we joined so we can reseed from them later.
+		m.joinLock.Lock()
+		m.joinNodes = existing
+		m.joinLock.Unlock()
 	}
 	return numSuccess, errs
 }
 
+// JoinAndWait joins the cluster via the given seeds, just like Join, and then
+// waits until we know about at least minMembers live nodes, including
+// ourselves. The timeout only applies to the wait, since the join itself is
+// already bounded by TCPTimeout for each seed. This returns an error if the
+// join fails, or if we still don't see enough members once the timeout is
+// reached, in which case we are still joined to the cluster.
+func (m *Memberlist) JoinAndWait(seeds []string, minMembers int, timeout time.Duration) error {
+	if _, err := m.Join(seeds); err != nil {
+		return fmt.Errorf("Failed to join: %v", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	ticker := time.NewTicker(joinWaitInterval)
+	defer ticker.Stop()
+	for {
+		num := m.NumMembers()
+		if num >= minMembers {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("Joined, but timed out waiting for %d members (have %d)", minMembers, num)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-m.shutdownCh:
+			return fmt.Errorf("Joined, but shut down while waiting for %d members (have %d)", minMembers, num)
+		}
+	}
+}
+
 // ipPort holds information about a node we want to try to join.
 type ipPort struct {
 	ip   net.IP
@@ -272,50 +448,125 @@ func (m *Memberlist) tcpLookupIP(host string, defaultPort uint16) ([]ipPort, err
 		dn = dn + "."
 	}
 
+	in, err := m.tcpExchange(dn, dns.TypeANY)
+	if err != nil || in == nil {
+		return nil, err
+	}
+
+	// Handle any IPs we get back that we can attempt to join.
+	var ips []ipPort
+	for _, r := range in.Answer {
+		switch rr := r.(type) {
+		case (*dns.A):
+			ips = append(ips, ipPort{rr.A, defaultPort})
+		case (*dns.AAAA):
+			ips = append(ips, ipPort{rr.AAAA, defaultPort})
+		case (*dns.CNAME):
+			m.logger.Printf("[DEBUG] memberlist: Ignoring CNAME RR in TCP-first answer for '%s'", host)
+		}
+	}
+	return ips, nil
+}
+
+// tcpExchange sends a DNS query for the given fully qualified name and record
+// type over TCP to the first server in the DNS config. This returns a nil
+// answer if there's no server to ask.
+func (m *Memberlist) tcpExchange(dn string, qtype uint16) (*dns.Msg, error) {
 	// See if we can find a server to try.
 	cc, err := dns.ClientConfigFromFile(m.config.DNSConfigPath)
 	if err != nil {
 		return nil, err
 	}
-	if len(cc.Servers) > 0 {
-		// We support host:port in the DNS config, but need to add the
-		// default port if one is not supplied.
-		server := cc.Servers[0]
-		if !hasPort(server) {
-			server = net.JoinHostPort(server, cc.Port)
-		}
+	if len(cc.Servers) == 0 {
+		return nil, nil
+	}
 
-		// Do the lookup.
-		c := new(dns.Client)
-		c.Net = "tcp"
-		msg := new(dns.Msg)
-		msg.SetQuestion(dn, dns.TypeANY)
-		in, _, err := c.Exchange(msg, server)
-		if err != nil {
-			return nil, err
-		}
+	// We support host:port in the DNS config, but need to add the
+	// default port if one is not supplied.
+	server := cc.Servers[0]
+	if !hasPort(server) {
+		server = net.JoinHostPort(server, cc.Port)
+	}
+
+	// Do the lookup.
+	c := new(dns.Client)
+	c.Net = "tcp"
+	msg := new(dns.Msg)
+	msg.SetQuestion(dn, qtype)
+	in, _, err := c.Exchange(msg, server)
+	return in, err
+}
+
+// lookupSRV resolves an SRV name, like _memberlist._tcp.example.com, into the
+// addresses and ports of its targets. Like tcpLookupIP, this asks the DNS
+// server over TCP first, and falls back to the Go resolver.
+func (m *Memberlist) lookupSRV(name string) ([]ipPort, error) {
+	dn := name
+	if dn[len(dn)-1] != '.' {
+		dn = dn + "."
+	}
 
-		// Handle any IPs we get back that we can attempt to join.
-		var ips []ipPort
+	// Servers usually include the targets' addresses along with the SRV
+	// records, which saves us looking them up one by one.
+	var srvs []*net.SRV
+	known := make(map[string][]net.IP)
+	in, err := m.tcpExchange(dn, dns.TypeSRV)
+	if err != nil {
+		m.logger.Printf("[DEBUG] memberlist: TCP-first SRV lookup failed for '%s', falling back to UDP: %s", name, err)
+	}
+	if in != nil {
 		for _, r := range in.Answer {
+			if rr, ok := r.(*dns.SRV); ok {
+				srvs = append(srvs, &net.SRV{Target: rr.Target, Port: rr.Port})
+			}
+		}
+		for _, r := range in.Extra {
+			target := strings.ToLower(r.Header().Name)
 			switch rr := r.(type) {
 			case (*dns.A):
-				ips = append(ips, ipPort{rr.A, defaultPort})
+				known[target] = append(known[target], rr.A)
 			case (*dns.AAAA):
-				ips = append(ips, ipPort{rr.AAAA, defaultPort})
-			case (*dns.CNAME):
-				m.logger.Printf("[DEBUG] memberlist: Ignoring CNAME RR in TCP-first answer for '%s'", host)
+				known[target] = append(known[target], rr.AAAA)
 			}
 		}
-		return ips, nil
+	}
+	if len(srvs) == 0 {
+		if _, srvs, err = net.LookupSRV("", "", name); err != nil {
+			return nil, err
+		}
 	}
 
-	return nil, nil
+	var ips []ipPort
+	for _, srv := range srvs {
+		addrs, ok := known[strings.ToLower(srv.Target)]
+		if !ok {
+			if addrs, err = net.LookupIP(srv.Target); err != nil {
+				m.logger.Printf("[WARN] memberlist: Failed to resolve SRV target '%s' for '%s': %s", srv.Target, name, err)
+				continue
+			}
+		}
+		for _, ip := range addrs {
+			ips = append(ips, ipPort{ip, srv.Port})
+		}
+	}
+	return ips, nil
 }
 
 // resolveAddr is used to resolve the address into an address,
 // port, and error. If no port is given, use the default
 func (m *Memberlist) resolveAddr(hostStr string) ([]ipPort, error) {
+	// SRV names carry their own ports, so if no port was given for one of
+	// those, see if there are any records before treating it as a host.
+	if !hasPort(hostStr) && strings.HasPrefix(hostStr, "_") {
+		ips, err := m.lookupSRV(hostStr)
+		if err != nil {
+			m.logger.Printf("[DEBUG] memberlist: SRV lookup failed for '%s', falling back to a host lookup: %s", hostStr, err)
+		}
+		if len(ips) > 0 {
+			return m.orderAddrs(ips), nil
+		}
+	}
+
 	// This captures the supplied port, or the default one.
 	hostStr = ensurePort(hostStr, m.config.BindPort)
 	host, sport, err := net.SplitHostPort(hostStr)
@@ -343,7 +594,7 @@ func (m *Memberlist) resolveAddr(hostStr string) ([]ipPort, error) {
 		m.logger.Printf("[DEBUG] memberlist: TCP-first lookup failed for '%s', falling back to UDP: %s", hostStr, err)
 	}
 	if len(ips) > 0 {
-		return ips, nil
+		return m.orderAddrs(ips), nil
 	}
 
 	// If TCP didn't yield anything then use the normal Go resolver which
@@ -357,7 +608,19 @@ func (m *Memberlist) resolveAddr(hostStr string) ([]ipPort, error) {
 	for _, ip := range ans {
 		ips = append(ips, ipPort{ip, port})
 	}
-	return ips, nil
+	return m.orderAddrs(ips), nil
+}
+
+// orderAddrs moves IPv6 addresses to the front if PreferIPv6 is set, keeping
+// the resolver's order otherwise.
+func (m *Memberlist) orderAddrs(ips []ipPort) []ipPort {
+	if !m.config.PreferIPv6 {
+		return ips
+	}
+	sort.SliceStable(ips, func(i, j int) bool {
+		return ips[i].ip.To4() == nil && ips[j].ip.To4() != nil
+	})
+	return ips
 }
 
 // setAlive is used to mark this node as being alive. This is the same
@@ -399,6 +662,7 @@ func (m *Memberlist) setAlive() error {
 	a := alive{
 		Incarnation: m.nextIncarnation(),
 		Node:        m.config.Name,
+		ID:          m.config.ID,
 		Addr:        addr,
 		Port:        uint16(port),
 		Meta:        meta,
@@ -412,12 +676,103 @@ func (m *Memberlist) setAlive() error {
 	return nil
 }
 
-// LocalNode is used to return the local Node
+// addInitialMembers adds all the configured InitialMembers as alive nodes.
+func (m *Memberlist) addInitialMembers() {
+	for _, n := range m.config.InitialMembers {
+		if n.Name == m.config.Name {
+			continue
+		}
+
+		a := m.seedAlive(&n)
+		m.aliveNode(&a, nil, true)
+	}
+}
+
+// AddKnownNodes feeds in nodes learned from an outside source of truth, such
+// as a service registry, so they can be brought into the cluster before
+// gossip gets around to them. Nodes we don't know about yet are held as
+// pending and pinged directly, the same way as with ConfirmBeforeAdd, and
+// are only added to the member list if they answer. This way a stale entry
+// in the registry can't add a dead node. Nodes we already know about are
+// left alone, since our own view of them is more up to date.
+func (m *Memberlist) AddKnownNodes(nodes []Node) {
+	m.nodeLock.Lock()
+	defer m.nodeLock.Unlock()
+
+	for i := range nodes {
+		n := &nodes[i]
+		if _, ok := m.nodeMap[n.Name]; ok || n.Name == m.config.Name {
+			continue
+		}
+
+		a := m.seedAlive(n)
+		m.confirmPending(&a)
+	}
+}
+
+// seedAlive builds an alive message for a node we've been told about from
+// outside the cluster, falling back to our own protocol versions if none are
+// given for the node. The incarnation is the lowest a node can have, so the
+// node's own view of itself always wins.
+func (m *Memberlist) seedAlive(n *Node) alive {
+	vsn := []uint8{n.PMin, n.PMax, n.PCur, n.DMin, n.DMax, n.DCur}
+	if n.PMax == 0 {
+		vsn = []uint8{
+			ProtocolVersionMin, ProtocolVersionMax, m.config.ProtocolVersion,
+			m.config.DelegateProtocolMin, m.config.DelegateProtocolMax,
+			m.config.DelegateProtocolVersion,
+		}
+	}
+	return alive{
+		Incarnation: 1,
+		Node:        n.Name,
+		ID:          n.ID,
+		Addr:        n.Addr,
+		Port:        n.Port,
+		Meta:        n.Meta,
+		Vsn:         vsn,
+	}
+}
+
+// LocalNode is used to return the local Node, as seen by the rest of the
+// cluster. This returns a copy, so it's safe to hold on to. If we haven't
+// finished starting up yet, this is pieced together from the configuration.
 func (m *Memberlist) LocalNode() *Node {
 	m.nodeLock.RLock()
-	defer m.nodeLock.RUnlock()
-	state := m.nodeMap[m.config.Name]
-	return &state.Node
+	state, ok := m.nodeMap[m.config.Name]
+	var node Node
+	if ok {
+		node = state.Node
+		node.Meta = append([]byte(nil), state.Meta...)
+	}
+	m.nodeLock.RUnlock()
+
+	if !ok {
+		node = m.configNode()
+	}
+	return &node
+}
+
+// configNode builds our local Node from the configuration, for when we're not
+// in the node map yet. The advertise address is preferred over the bind
+// address when set.
+func (m *Memberlist) configNode() Node {
+	addr, port := m.config.AdvertiseAddr, m.config.AdvertisePort
+	if addr == "" {
+		addr, port = m.config.BindAddr, m.config.BindPort
+	}
+	return Node{
+		Name: m.config.Name,
+		ID:   m.config.ID,
+		Addr: net.ParseIP(addr),
+		Port: uint16(port),
+		PMin: ProtocolVersionMin,
+		PMax: ProtocolVersionMax,
+		PCur: m.config.ProtocolVersion,
+		DMin: m.config.DelegateProtocolMin,
+		DMax: m.config.DelegateProtocolMax,
+		DCur: m.config.DelegateProtocolVersion,
+	}
 }
 
 // UpdateNode is used to trigger re-advertising the local node. This is
@@ -435,6 +790,106 @@ func (m *Memberlist) UpdateNode(timeout time.Duration) error {
 		}
 	}
 
+	_, notifyCh := m.updateNode(meta)
+
+	// Wait for the broadcast or a timeout
+	if m.anyAlive() {
+		var timeoutCh <-chan time.Time
+		if timeout > 0 {
+			timeoutCh = time.After(timeout)
+		}
+		select {
+		case <-notifyCh:
+		case <-timeoutCh:
+			return fmt.Errorf("timeout waiting for update broadcast")
+		}
+	}
+	return nil
+}
+
+// UpdateMetaAndWait re-advertises the local node with the given meta data,
+// like UpdateNode, and then waits until at least minPeers live peers have
+// confirmed that they've seen the new incarnation, or until the timeout is
+// reached. Peers are asked directly, so this gives a barrier for meta changes
+// that need to be visible around the cluster before moving on. Note that the
+// Delegate's NodeMeta will take over again on the next UpdateNode.
+func (m *Memberlist) UpdateMetaAndWait(meta []byte, minPeers int, timeout time.Duration) error {
+	if len(meta) > MetaMaxSize {
+		return fmt.Errorf("Node meta data is longer than the %d byte limit", MetaMaxSize)
+	}
+
+	// We don't wait for the broadcast to go out here, since asking the
+	// peers directly is a stronger check anyway.
+	deadline := time.Now().Add(timeout)
+	inc, _ := m.updateNode(meta)
+
+	confirmed := make(map[string]struct{})
+	for len(confirmed) < minPeers {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("Timed out waiting for %d peers to confirm the update (have %d)", minPeers, len(confirmed))
+		}
+
+		wait := m.config.ProbeTimeout
+		if wait > remaining {
+			wait = remaining
+		}
+		m.confirmIncarnation(inc, confirmed, wait)
+	}
+	return nil
+}
+
+// confirmIncarnation asks every live peer that's not in confirmed yet whether
+// it has seen the given incarnation of us, adding the ones that have. This
+// waits the given amount of time for the answers to come back.
+func (m *Memberlist) confirmIncarnation(inc uint32, confirmed map[string]struct{}, wait time.Duration) {
+	m.nodeLock.RLock()
+	var peers []nodeState
+	for _, n := range m.nodes {
+		if n.Name == m.config.Name || n.State != stateAlive {
+			continue
+		}
+		if _, ok := confirmed[n.Name]; ok {
+			continue
+		}
+		peers = append(peers, *n)
+	}
+	m.nodeLock.RUnlock()
+
+	ackCh := make(chan string, len(peers))
+	for _, peer := range peers {
+		name := peer.Name
+		ackFn := func(payload []byte, timestamp time.Time) {
+			if bytes.Equal(payload, []byte{1}) {
+				ackCh <- name
+			}
+		}
+
+		p := ping{SeqNo: m.nextSeqNo(), Node: name, Member: m.config.Name, MemberIncarnation: inc}
+		if err := m.setAckHandler(p.SeqNo, ackFn, wait); err != nil {
+			m.logger.Printf("[WARN] memberlist: Failed to confirm update with %s: %s", name, err)
+			break
+		}
+		if err := m.encodeAndSendMsg(peer.Address(), pingMsg, &p); err != nil {
+			m.logger.Printf("[ERR] memberlist: Failed to confirm update with %s: %s", name, err)
+		}
+	}
+
+	timeoutCh := time.After(wait)
+	for {
+		select {
+		case name := <-ackCh:
+			confirmed[name] = struct{}{}
+		case <-timeoutCh:
+			return
+		}
+	}
+}
+
+// updateNode re-advertises the local node with the given meta data. This
+// returns the new incarnation number, and a channel that's closed once the
+// broadcast has gone out.
+func (m *Memberlist) updateNode(meta []byte) (uint32, chan struct{}) {
 	// Get the existing node
 	m.nodeLock.RLock()
 	state := m.nodeMap[m.config.Name]
@@ -444,6 +899,7 @@ func (m *Memberlist) UpdateNode(timeout time.Duration) error {
 	a := alive{
 		Incarnation: m.nextIncarnation(),
 		Node:        m.config.Name,
+		ID:          m.config.ID,
 		Addr:        state.Addr,
 		Port:        state.Port,
 		Meta:        meta,
@@ -455,29 +911,131 @@ func (m *Memberlist) UpdateNode(timeout time.Duration) error {
 	}
 	notifyCh := make(chan struct{})
 	m.aliveNode(&a, notifyCh, true)
+	return a.Incarnation, notifyCh
+}
 
-	// Wait for the broadcast or a timeout
-	if m.anyAlive() {
-		var timeoutCh <-chan time.Time
-		if timeout > 0 {
-			timeoutCh = time.After(timeout)
+// Refresh re-advertises the local node with a new incarnation number and
+// sends the alive message directly to GossipNodes random peers, rather than
+// waiting for the next gossip round. This is useful to quickly recover from
+// a transient local connectivity problem, such as a NIC flap, during which
+// peers may have started to suspect us. The alive message is also queued
+// for regular gossip.
+func (m *Memberlist) Refresh() {
+	if m.hasLeft() {
+		m.logger.Printf("[WARN] memberlist: Refresh but we've already left")
+		return
+	}
+
+	// Format a new alive message from our current state
+	m.nodeLock.RLock()
+	state, ok := m.nodeMap[m.config.Name]
+	if !ok {
+		m.nodeLock.RUnlock()
+		m.logger.Printf("[WARN] memberlist: Refresh but we don't know about ourselves yet")
+		return
+	}
+	a := alive{
+		Incarnation: m.nextIncarnation(),
+		Node:        state.Name,
+		ID:          state.ID,
+		Addr:        state.Addr,
+		Port:        state.Port,
+		Meta:        state.Meta,
+		Vsn: []uint8{
+			state.PMin, state.PMax, state.PCur,
+			state.DMin, state.DMax, state.DCur,
+		},
+	}
+	m.nodeLock.RUnlock()
+	m.aliveNode(&a, nil, true)
+
+	// Get some random peers that aren't dead
+	m.nodeLock.RLock()
+	kNodes := kRandomNodes(m.rng, m.config.GossipNodes, m.nodes, func(n *nodeState) bool {
+		return n.Name == m.config.Name ||
+			n.State == stateDead
+	})
+	m.nodeLock.RUnlock()
+
+	for _, node := range kNodes {
+		out := a
+		out.Addr = m.advertiseAddrFor(node.Addr, a.Addr)
+		if err := m.encodeAndSendMsg(node.Address(), aliveMsg, &out); err != nil {
+			m.logger.Printf("[ERR] memberlist: Failed to send refresh to %s: %s", node.Address(), err)
 		}
-		select {
-		case <-notifyCh:
-		case <-timeoutCh:
-			return fmt.Errorf("timeout waiting for update broadcast")
+	}
+}
+
+// advertiseAddrFor returns the address we should advertise to the given
+// destination, which is the given default unless an AdvertiseAddrFunc says
+// otherwise.
+func (m *Memberlist) advertiseAddrFor(dest net.IP, def []byte) []byte {
+	if m.config.AdvertiseAddrFunc == nil || dest == nil {
+		return def
+	}
+	if addr := m.config.AdvertiseAddrFunc(dest); addr != nil {
+		if ip4 := addr.To4(); ip4 != nil {
+			return ip4
+		}
+		return addr
+	}
+	return def
+}
+
+// VerifyJoined checks that the cluster has actually learned about us, by
+// asking a random live peer whether it has this node in its member list.
+// This catches one-way joins, where we've learned about the cluster but our
+// own alive message never made it out, which can happen with asymmetric NAT.
+// An error is returned if there are no peers to ask, if the peer doesn't
+// know about us, or if no answer arrives within the given timeout, which
+// defaults to the ProbeTimeout if zero.
+func (m *Memberlist) VerifyJoined(timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = m.config.ProbeTimeout
+	}
+
+	// Get a random live peer. We don't use kRandomNodes here since it may
+	// come up empty in small clusters.
+	var peers []nodeState
+	m.nodeLock.RLock()
+	for _, n := range m.nodes {
+		if n.Name != m.config.Name && n.State == stateAlive {
+			peers = append(peers, *n)
 		}
 	}
+	m.nodeLock.RUnlock()
+	if len(peers) == 0 {
+		return fmt.Errorf("no live peers to verify the join with")
+	}
+	peer := peers[randomOffset(m.rng, len(peers))]
+
+	// Ask the peer if it knows about us.
+	p := ping{SeqNo: m.nextSeqNo(), Node: peer.Name, Member: m.config.Name}
+	ackCh := make(chan ackMessage, 1)
+	if err := m.setProbeChannels(p.SeqNo, ackCh, nil, timeout); err != nil {
+		return err
+	}
+	if err := m.encodeAndSendMsg(peer.Address(), pingMsg, &p); err != nil {
+		return err
+	}
+
+	v := <-ackCh
+	if !v.Complete {
+		return fmt.Errorf("timeout waiting for join verification from %s", peer.Name)
+	}
+	if !bytes.Equal(v.Payload, []byte{1}) {
+		return fmt.Errorf("node %s doesn't know about us", peer.Name)
+	}
 	return nil
 }
 
 // SendTo is deprecated in favor of SendBestEffort, which requires a node to
 // target.
 func (m *Memberlist) SendTo(to net.Addr, msg []byte) error {
-	// Encode as a user message
-	buf := make([]byte, 1, len(msg)+1)
-	buf[0] = byte(userMsg)
-	buf = append(buf, msg...)
+	buf, err := m.encodeUserPacket(msg)
+	if err != nil {
+		return err
+	}
 
 	// Send the message
 	return m.rawSendMsgPacket(to.String(), nil, buf)
@@ -498,15 +1056,30 @@ func (m *Memberlist) SendToTCP(to *Node, msg []byte) error {
 // mechanism). The maximum size of the message depends on the configured
 // UDPBufferSize for this memberlist instance.
 func (m *Memberlist) SendBestEffort(to *Node, msg []byte) error {
-	// Encode as a user message
-	buf := make([]byte, 1, len(msg)+1)
-	buf[0] = byte(userMsg)
-	buf = append(buf, msg...)
+	buf, err := m.encodeUserPacket(msg)
+	if err != nil {
+		return err
+	}
 
 	// Send the message
 	return m.rawSendMsgPacket(to.Address(), to, buf)
 }
 
+// encodeUserPacket encodes a user message to be sent as a packet, returning
+// an error if it won't fit in UDPBufferSize.
+func (m *Memberlist) encodeUserPacket(msg []byte) ([]byte, error) {
+	limit := m.config.UDPBufferSize - m.packetOverhead()
+	if len(msg)+1 > limit {
+		return nil, fmt.Errorf("User message is too large for a packet (%d > %d bytes)",
+			len(msg)+1, limit)
+	}
+
+	buf := make([]byte, 1, len(msg)+1)
+	buf[0] = byte(userMsg)
+	buf = append(buf, msg...)
+	return buf, nil
+}
+
 // SendReliable uses the reliable stream-oriented interface of the transport to
 // target a user message at the given node (this does not use the gossip
 // mechanism). Delivery is guaranteed if no error is returned, and there is no
@@ -515,17 +1088,20 @@ func (m *Memberlist) SendReliable(to *Node, msg []byte) error {
 	return m.sendUserMsg(to.Address(), msg)
 }
 
-// Members returns a list of all known live nodes. The node structures
-// returned must not be modified. If you wish to modify a Node, make a
-// copy first.
+// Members returns a list of all known live nodes, including the local node.
+// The nodes returned are copies, so they're safe to hold on to and modify
+// without affecting our internal state. Suspect nodes are left out if
+// ExcludeSuspectFromMembers is set.
 func (m *Memberlist) Members() []*Node {
 	m.nodeLock.RLock()
 	defer m.nodeLock.RUnlock()
 
 	nodes := make([]*Node, 0, len(m.nodes))
 	for _, n := range m.nodes {
-		if n.State != stateDead {
-			nodes = append(nodes, &n.Node)
+		if m.isMember(n) {
+			node := n.Node
+			node.Meta = append([]byte(nil), n.Meta...)
+			nodes = append(nodes, &node)
 		}
 	}
 
@@ -541,7 +1117,7 @@ func (m *Memberlist) NumMembers() (alive int) {
 	defer m.nodeLock.RUnlock()
 
 	for _, n := range m.nodes {
-		if n.State != stateDead {
+		if m.isMember(n) {
 			alive++
 		}
 	}
@@ -549,6 +1125,129 @@ func (m *Memberlist) NumMembers() (alive int) {
 	return
 }
 
+// isMember returns true if the given node should be included by Members and
+// NumMembers. This must be called while the nodeLock is held.
+func (m *Memberlist) isMember(n *nodeState) bool {
+	if n.State == stateSuspect && m.config.ExcludeSuspectFromMembers {
+		return false
+	}
+	return n.State != stateDead
+}
+
+// ClearDead immediately removes all dead nodes from the member list, rather
+// than waiting for them to be reaped in the background, and returns the number
+// of nodes removed. This is useful for cleaning up after a known mass
+// termination. Note that the GossipToTheDeadTime isn't respected here, so
+// these nodes won't get any more chances to refute their death.
+func (m *Memberlist) ClearDead() int {
+	m.nodeLock.Lock()
+	defer m.nodeLock.Unlock()
+
+	// Move all the dead nodes to the end and deregister them
+	deadIdx := moveDeadNodes(m.nodes, 0)
+	for i := deadIdx; i < len(m.nodes); i++ {
+		m.deregisterNode(m.nodes[i])
+		m.nodes[i] = nil
+	}
+	removed := len(m.nodes) - deadIdx
+
+	// Trim the nodes to exclude the dead nodes
+	m.nodes = m.nodes[0:deadIdx]
+	atomic.StoreUint32(&m.numNodes, uint32(deadIdx))
+	return removed
+}
+
+// NodeByID returns the node with the given ID, or nil if we don't know about
+// it. See Config.ID for details.
+func (m *Memberlist) NodeByID(id string) *Node {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	state, ok := m.nodeIDs[id]
+	if !ok {
+		return nil
+	}
+	node := state.Node
+	node.Meta = append([]byte(nil), state.Meta...)
+	return &node
+}
+
+// UpdatedBy returns the name of the node that originated the last update we
+// accepted about the given node's state, which is useful for tracking down
+// where bad information came from, such as a node being wrongly declared
+// dead. For alive nodes this is the node itself, since only it can announce
+// that it's alive. For suspect or dead nodes this is the node that accused
+// it, which is us if we came to that conclusion via our own probes or a
+// push/pull. The second return value is false if we don't know the node.
+func (m *Memberlist) UpdatedBy(name string) (string, bool) {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	state, ok := m.nodeMap[name]
+	if !ok {
+		return "", false
+	}
+	return state.UpdatedBy, true
+}
+
+// SeenIncarnation returns true if our view of the given node has reached at
+// least the given incarnation number. Applications that bump the incarnation
+// with UpdateNode can use this to check if a particular update has made it to
+// this node yet. This returns false for nodes we don't know about.
+func (m *Memberlist) SeenIncarnation(name string, inc uint32) bool {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	state, ok := m.nodeMap[name]
+	return ok && m.compareIncarnation(state.Incarnation, inc) >= 0
+}
+
+// IncarnationReport returns a snapshot of the incarnation number we currently
+// have for each known node, including dead ones. A node whose incarnation is
+// climbing much faster than the rest is likely crash looping or stuck in a
+// refute battle, which doesn't show up in its alive or dead state.
+func (m *Memberlist) IncarnationReport() map[string]uint32 {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	report := make(map[string]uint32, len(m.nodes))
+	for _, n := range m.nodes {
+		report[n.Name] = n.Incarnation
+	}
+	return report
+}
+
+// EncodeAlive returns the encoded alive message for the given node's current
+// state, exactly as it would be queued for broadcast. This is useful for
+// debugging and for checking wire compatibility. Nothing is sent.
+func (m *Memberlist) EncodeAlive(name string) ([]byte, error) {
+	m.nodeLock.RLock()
+	state, ok := m.nodeMap[name]
+	if !ok {
+		m.nodeLock.RUnlock()
+		return nil, fmt.Errorf("Unknown node %q", name)
+	}
+	a := alive{
+		Incarnation: state.Incarnation,
+		Node:        state.Name,
+		ID:          state.ID,
+		Addr:        state.Addr,
+		Port:        state.Port,
+		Meta:        state.Meta,
+		Vsn: []uint8{
+			state.PMin, state.PMax, state.PCur,
+			state.DMin, state.DMax, state.DCur,
+		},
+	}
+	m.nodeLock.RUnlock()
+
+	buf, err := encode(aliveMsg, &a)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 // Leave will broadcast a leave message but will not shutdown the background
 // listeners, meaning the node will continue participating in gossip and state
 // updates.
@@ -613,6 +1312,41 @@ func (m *Memberlist) anyAlive() bool {
 	return false
 }
 
+// ForceLeave marks the node with the given name as dead and broadcasts that
+// to the cluster. This is for evicting nodes that are known to be gone for
+// good but are lingering, like a ghost that keeps getting gossiped about. The
+// dead message uses a higher incarnation than we know of for the node, so it
+// wins over any alive messages still going around. If the node is actually
+// still running it will refute this as usual. This can't be used on the local
+// node, use Leave for that.
+func (m *Memberlist) ForceLeave(name string) error {
+	if name == m.config.Name {
+		return fmt.Errorf("Can't force the local node to leave, use Leave instead")
+	}
+
+	m.nodeLock.RLock()
+	state, ok := m.nodeMap[name]
+	var inc uint32
+	if ok {
+		inc = state.Incarnation
+	}
+	m.nodeLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("Unknown node %q", name)
+	}
+
+	d := dead{Incarnation: inc + 1, Node: name, From: m.config.Name}
+	m.deadNode(&d)
+	return nil
+}
+
+// IsAlone returns true if we don't know about any other node that isn't
+// dead. This is the case right after Create, as well as when we've failed
+// to join a cluster or have been fully partitioned from it.
+func (m *Memberlist) IsAlone() bool {
+	return !m.anyAlive()
+}
+
 // GetHealthScore gives this instance's idea of how well it is meeting the soft
 // real-time requirements of the protocol. Lower numbers are better, and zero
 // means "totally healthy".
@@ -620,6 +1354,52 @@ func (m *Memberlist) GetHealthScore() int {
 	return m.awareness.GetHealthScore()
 }
 
+// GossipFanout returns the number of nodes that were picked to gossip to in
+// the last gossip round, or GossipNodes if there hasn't been one yet. This is
+// GossipNodes unless MaxGossipNodes allowed it to grow because of a backlog
+// of broadcasts.
+func (m *Memberlist) GossipFanout() int {
+	return int(atomic.LoadInt32(&m.lastGossipFanout))
+}
+
+// PendingAcks returns the number of acks we're currently waiting on, from
+// probes, pings, and indirect pings we're relaying for other nodes. New ones
+// are refused once this reaches MaxPendingAcks.
+func (m *Memberlist) PendingAcks() int {
+	m.ackLock.Lock()
+	defer m.ackLock.Unlock()
+	return len(m.ackHandlers)
+}
+
+// EstimatedDetectionTime returns a worst-case estimate, given the current
+// configuration and cluster size, of how long it takes from a node failing to
+// the rest of the cluster knowing that it's dead. This adds up the time for
+// the failed node to come up in the probe rotation, the failed probe itself,
+// the suspicion timeout assuming no other nodes confirm the suspicion, and
+// the retransmits of the dead message, which go out once per gossip
+// interval. Degraded health scales the probe interval up beyond this, so the
+// estimate is for a healthy node.
+func (m *Memberlist) EstimatedDetectionTime() time.Duration {
+	n := m.estNumNodes()
+	probe := m.config.ProbeInterval
+
+	// Work out the suspicion timeout the same way suspectNode does. If
+	// there are confirmations to wait for then the worst case is that none
+	// arrive and we wait for the max.
+	k := m.config.SuspicionMult - 2
+	if n-2 < k {
+		k = 0
+	}
+	suspicion := suspicionTimeout(m.config.SuspicionMult, n, probe)
+	if k >= 1 {
+		suspicion = time.Duration(m.config.SuspicionMaxTimeoutMult) * suspicion
+	}
+
+	rotation := time.Duration(n-1) * probe
+	gossip := time.Duration(retransmitLimit(m.config.RetransmitMult, n)) * m.config.GossipInterval
+	return rotation + probe + suspicion + gossip
+}
+
 // ProtocolVersion returns the protocol version currently in use by
 // this memberlist.
 func (m *Memberlist) ProtocolVersion() uint8 {
@@ -629,6 +1409,48 @@ func (m *Memberlist) ProtocolVersion() uint8 {
 	return m.config.ProtocolVersion
 }
 
+// AddKey installs a new gossip encryption key, which will be tried when
+// decrypting messages. Encryption must already be enabled via the Keyring or
+// SecretKey. Install a key on every node before promoting it with UseKey.
+func (m *Memberlist) AddKey(key []byte) error {
+	if !m.config.EncryptionEnabled() {
+		return fmt.Errorf("Encryption is not enabled")
+	}
+	return m.config.Keyring.AddKey(key)
+}
+
+// UseKey makes an installed key the primary one, which is used to encrypt
+// all outgoing messages.
+func (m *Memberlist) UseKey(key []byte) error {
+	if !m.config.EncryptionEnabled() {
+		return fmt.Errorf("Encryption is not enabled")
+	}
+	return m.config.Keyring.UseKey(key)
+}
+
+// RemoveKey uninstalls a gossip encryption key. The primary key can't be
+// removed.
+func (m *Memberlist) RemoveKey(key []byte) error {
+	if !m.config.EncryptionEnabled() {
+		return fmt.Errorf("Encryption is not enabled")
+	}
+	return m.config.Keyring.RemoveKey(key)
+}
+
+// GetGossipKeys returns a copy of the installed gossip encryption keys, with
+// the primary key first. This returns nil if encryption isn't enabled.
+func (m *Memberlist) GetGossipKeys() [][]byte {
+	if !m.config.EncryptionEnabled() {
+		return nil
+	}
+
+	var keys [][]byte
+	for _, key := range m.config.Keyring.GetKeys() {
+		keys = append(keys, append([]byte(nil), key...))
+	}
+	return keys
+}
+
 // Shutdown will stop any background maintanence of network activity
 // for this memberlist, causing it to appear "dead". A leave message
 // will not be broadcasted prior, so the cluster being left will have
@@ -13,20 +13,25 @@ import (
 	"testing"
 	"time"
 
+	metrics "github.com/armon/go-metrics"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
 )
 
 var bindLock sync.Mutex
+var bindNet byte = 0
 var bindNum byte = 10
 
 func getBindAddr() net.IP {
 	bindLock.Lock()
 	defer bindLock.Unlock()
 
-	result := net.IPv4(127, 0, 0, bindNum)
+	result := net.IPv4(127, 0, bindNet, bindNum)
 	bindNum++
-	if bindNum > 255 {
+	if bindNum == 0 {
+		// Move on to the next network rather than reusing addresses that
+		// earlier tests may have left listening.
+		bindNet++
 		bindNum = 10
 	}
 
@@ -236,6 +241,55 @@ func TestCreate_keyringAndSecretKey(t *testing.T) {
 	}
 }
 
+func TestMemberlist_GossipKeys(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	key1 := []byte{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}
+	key2 := []byte{2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2}
+
+	// Without encryption there's no keyring to manage.
+	if err := m.AddKey(key1); err == nil {
+		t.Fatalf("expected error without encryption")
+	}
+	if keys := m.GetGossipKeys(); keys != nil {
+		t.Fatalf("expected no keys, got %v", keys)
+	}
+
+	keyring, err := NewKeyring(nil, key1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	m.config.Keyring = keyring
+
+	if err := m.AddKey(key2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := m.UseKey(key2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	keys := m.GetGossipKeys()
+	if !reflect.DeepEqual(keys, [][]byte{key2, key1}) {
+		t.Fatalf("bad keys: %v", keys)
+	}
+
+	// Changing the copy shouldn't touch the ring.
+	keys[0][0] = 9
+	if !bytes.Equal(keyring.GetPrimaryKey(), key2) {
+		t.Fatalf("expected the keyring to be unchanged")
+	}
+
+	if err := m.RemoveKey(key2); err == nil {
+		t.Fatalf("expected error removing the primary key")
+	}
+	if err := m.RemoveKey(key1); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if keys := m.GetGossipKeys(); !reflect.DeepEqual(keys, [][]byte{key2}) {
+		t.Fatalf("bad keys: %v", keys)
+	}
+}
+
 func TestCreate_invalidLoggerSettings(t *testing.T) {
 	c := DefaultLANConfig()
 	c.BindAddr = getBindAddr().String()
@@ -293,6 +347,71 @@ func TestCreate(t *testing.T) {
 	}
 }
 
+func TestCreate_NameGenerator(t *testing.T) {
+	c1 := testConfig()
+	c1.Name = ""
+	c1.NameGenerator = func() string {
+		return "generated"
+	}
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+	if name := m1.LocalNode().Name; name != "generated" {
+		t.Fatalf("bad: %s", name)
+	}
+
+	// Without a generator we should get the hostname plus a suffix.
+	c2 := testConfig()
+	c2.Name = ""
+	c2.BindPort = m1.config.BindPort
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+	hostname, _ := os.Hostname()
+	if name := m2.LocalNode().Name; !strings.HasPrefix(name, hostname+"-") {
+		t.Fatalf("bad: %s", name)
+	}
+}
+
+func TestCreate_InitialMembers(t *testing.T) {
+	c1 := testConfig()
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.BindPort = m1.config.BindPort
+	c2.InitialMembers = []Node{*m1.LocalNode(), {Name: c2.Name}}
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	// m2 should know about m1 right away, without joining, and our own
+	// entry should have been ignored.
+	if num := m2.NumMembers(); num != 2 {
+		t.Fatalf("bad: %d", num)
+	}
+	m2.nodeLock.RLock()
+	state, ok := m2.nodeMap[c1.Name]
+	if !ok || state.State != stateAlive || state.Incarnation != 1 ||
+		state.PCur != c1.ProtocolVersion {
+		t.Fatalf("bad: %#v", state)
+	}
+	local := m2.nodeMap[c2.Name]
+	if local.Port != uint16(c2.BindPort) {
+		t.Fatalf("bad: %#v", local)
+	}
+	m2.nodeLock.RUnlock()
+}
+
 func TestMemberList_CreateShutdown(t *testing.T) {
 	m := GetMemberlist(t)
 	m.schedule()
@@ -335,6 +454,29 @@ func TestMemberList_ResolveAddr(t *testing.T) {
 	}
 }
 
+func TestMemberList_OrderAddrs(t *testing.T) {
+	m := GetMemberlist(t)
+	ips := func() []ipPort {
+		return []ipPort{
+			{net.ParseIP("10.0.0.1"), 7946},
+			{net.ParseIP("2001:db8::1"), 7946},
+			{net.ParseIP("10.0.0.2"), 7946},
+			{net.ParseIP("2001:db8::2"), 7946},
+		}
+	}
+
+	if out := m.orderAddrs(ips()); !reflect.DeepEqual(out, ips()) {
+		t.Fatalf("expected the order to be kept, got %v", out)
+	}
+
+	m.config.PreferIPv6 = true
+	in := ips()
+	expected := []ipPort{in[1], in[3], in[0], in[2]}
+	if out := m.orderAddrs(in); !reflect.DeepEqual(out, expected) {
+		t.Fatalf("expected IPv6 first, got %v", out)
+	}
+}
+
 type dnsHandler struct {
 	t *testing.T
 }
@@ -437,12 +579,110 @@ func TestMemberList_ResolveAddr_TCP_First(t *testing.T) {
 	}
 }
 
+type srvHandler struct {
+	t *testing.T
+}
+
+func (h srvHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	if len(r.Question) != 1 {
+		h.t.Fatalf("bad: %#v", r.Question)
+	}
+
+	name := "_memberlist._tcp.service.consul."
+	question := r.Question[0]
+	if question.Name != name || question.Qtype != dns.TypeSRV {
+		h.t.Fatalf("bad: %#v", question)
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	m.RecursionAvailable = false
+	for i, target := range []string{"node1.service.consul.", "node2.service.consul."} {
+		m.Answer = append(m.Answer, &dns.SRV{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeSRV,
+				Class:  dns.ClassINET},
+			Target: target,
+			Port:   uint16(8000 + i),
+		})
+	}
+	m.Extra = append(m.Extra, &dns.A{
+		Hdr: dns.RR_Header{
+			Name:   "node1.service.consul.",
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET},
+		A: net.ParseIP("127.0.0.1"),
+	})
+	m.Extra = append(m.Extra, &dns.AAAA{
+		Hdr: dns.RR_Header{
+			Name:   "node2.service.consul.",
+			Rrtype: dns.TypeAAAA,
+			Class:  dns.ClassINET},
+		AAAA: net.ParseIP("2001:db8:a0b:12f0::1"),
+	})
+	if err := w.WriteMsg(m); err != nil {
+		h.t.Fatalf("err: %v", err)
+	}
+}
+
+func TestMemberList_ResolveAddr_SRV(t *testing.T) {
+	bind := "127.0.0.1:8601"
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	server := &dns.Server{
+		Addr:              bind,
+		Handler:           srvHandler{t},
+		Net:               "tcp",
+		NotifyStartedFunc: wg.Done,
+	}
+	defer server.Shutdown()
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+			t.Errorf("err: %v", err)
+		}
+	}()
+	wg.Wait()
+
+	tmpFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	content := []byte(fmt.Sprintf("nameserver %s", bind))
+	if _, err := tmpFile.Write(content); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	m := GetMemberlist(t)
+	m.config.DNSConfigPath = tmpFile.Name()
+	defer m.Shutdown()
+
+	// The ports should come from the SRV records, not the default.
+	ips, err := m.resolveAddr("_memberlist._tcp.service.consul")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := []ipPort{
+		ipPort{net.ParseIP("127.0.0.1").To4(), 8000},
+		ipPort{net.ParseIP("2001:db8:a0b:12f0::1"), 8001},
+	}
+	require.Equal(t, expected, ips)
+}
+
 func TestMemberList_Members(t *testing.T) {
 	n1 := &Node{Name: "test"}
 	n2 := &Node{Name: "test2"}
 	n3 := &Node{Name: "test3"}
 
-	m := &Memberlist{}
+	m := &Memberlist{config: &Config{}}
 	nodes := []*nodeState{
 		&nodeState{Node: *n1, State: stateAlive},
 		&nodeState{Node: *n2, State: stateDead},
@@ -454,6 +694,192 @@ func TestMemberList_Members(t *testing.T) {
 	if !reflect.DeepEqual(members, []*Node{n1, n3}) {
 		t.Fatalf("bad members")
 	}
+
+	// Changing what we got back shouldn't touch our own state.
+	m.nodes[0].Meta = []byte("meta")
+	members = m.Members()
+	members[0].Name = "changed"
+	members[0].Meta[0] = 'x'
+	if m.nodes[0].Name != "test" || string(m.nodes[0].Meta) != "meta" {
+		t.Fatalf("members should be copies: %v", m.nodes[0].Node)
+	}
+
+	// Suspect nodes can be left out as well.
+	m.config.ExcludeSuspectFromMembers = true
+	members = m.Members()
+	if len(members) != 1 || members[0].Name != "test" {
+		t.Fatalf("bad members: %v", members)
+	}
+	if num := m.NumMembers(); num != 1 {
+		t.Fatalf("bad: %d", num)
+	}
+}
+
+func TestMemberList_NumMembers(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	m.config.GossipToTheDeadTime = 0
+	m.setAlive()
+
+	for i := 1; i <= 3; i++ {
+		a := alive{Node: fmt.Sprintf("test%d", i), Addr: []byte{127, 0, 0, byte(i)}, Incarnation: 1}
+		m.aliveNode(&a, nil, false)
+	}
+	d := dead{Node: "test1", From: "test2", Incarnation: 1}
+	m.deadNode(&d)
+	if num := m.NumMembers(); num != 3 {
+		t.Fatalf("bad: %d", num)
+	}
+
+	// Reaping the dead node shouldn't change the count.
+	time.Sleep(time.Millisecond)
+	m.resetNodes()
+	if num := m.NumMembers(); num != 3 {
+		t.Fatalf("bad: %d", num)
+	}
+	if len(m.nodes) != 3 {
+		t.Fatalf("expected dead node to be reaped: %d", len(m.nodes))
+	}
+}
+
+func TestMemberList_LocalNode(t *testing.T) {
+	m, d := GetMemberlistDelegate(t)
+	defer m.Shutdown()
+
+	// Before we're alive, this should come from the config.
+	n := m.LocalNode()
+	if n.Name != m.config.Name || n.Port != uint16(m.config.BindPort) ||
+		!n.Addr.Equal(net.ParseIP(m.config.BindAddr)) {
+		t.Fatalf("bad: %v", *n)
+	}
+
+	d.meta = []byte("meta")
+	if err := m.setAlive(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	n = m.LocalNode()
+	if string(n.Meta) != "meta" {
+		t.Fatalf("bad meta: %q", n.Meta)
+	}
+
+	// Changing the copy shouldn't touch our own state.
+	n.Meta[0] = 'x'
+	if meta := m.LocalNode().Meta; string(meta) != "meta" {
+		t.Fatalf("bad meta: %q", meta)
+	}
+}
+
+func TestMemberList_ClearDead(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	for i := 1; i <= 4; i++ {
+		a := alive{Node: fmt.Sprintf("test%d", i), Addr: []byte{127, 0, 0, byte(i)}, Incarnation: 1}
+		m.aliveNode(&a, nil, false)
+	}
+	for i := 1; i <= 2; i++ {
+		d := dead{Node: fmt.Sprintf("test%d", i), Incarnation: 1}
+		m.deadNode(&d)
+	}
+	time.Sleep(time.Millisecond)
+
+	if num := m.ClearDead(); num != 2 {
+		t.Fatalf("bad: %d", num)
+	}
+	if len(m.nodes) != 2 || len(m.nodeMap) != 2 || m.estNumNodes() != 2 {
+		t.Fatalf("bad: %v", m.nodes)
+	}
+	for _, name := range []string{"test1", "test2"} {
+		if _, ok := m.nodeMap[name]; ok {
+			t.Fatalf("%s should be unmapped", name)
+		}
+	}
+
+	if num := m.ClearDead(); num != 0 {
+		t.Fatalf("bad: %d", num)
+	}
+}
+
+func TestMemberList_SeenIncarnation(t *testing.T) {
+	m := &Memberlist{config: &Config{}, nodeMap: map[string]*nodeState{
+		"test": &nodeState{Node: Node{Name: "test"}, Incarnation: 5},
+	}}
+
+	if !m.SeenIncarnation("test", 4) || !m.SeenIncarnation("test", 5) {
+		t.Fatalf("should have seen it")
+	}
+	if m.SeenIncarnation("test", 6) {
+		t.Fatalf("should not have seen it")
+	}
+	if m.SeenIncarnation("nope", 0) {
+		t.Fatalf("should not have seen unknown node")
+	}
+}
+
+func TestMemberList_IncarnationReport(t *testing.T) {
+	m := &Memberlist{nodes: []*nodeState{
+		&nodeState{Node: Node{Name: "test1"}, Incarnation: 5, State: stateAlive},
+		&nodeState{Node: Node{Name: "test2"}, Incarnation: 42, State: stateDead},
+	}}
+
+	report := m.IncarnationReport()
+	expected := map[string]uint32{"test1": 5, "test2": 42}
+	if !reflect.DeepEqual(report, expected) {
+		t.Fatalf("bad: %v", report)
+	}
+
+	// The report should be a copy.
+	report["test1"] = 0
+	if m.nodes[0].Incarnation != 5 {
+		t.Fatalf("bad: %d", m.nodes[0].Incarnation)
+	}
+}
+
+func TestMemberlist_EncodeAlive(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	m.setAlive()
+
+	if _, err := m.EncodeAlive("nope"); err == nil {
+		t.Fatalf("should fail for unknown node")
+	}
+
+	buf, err := m.EncodeAlive(m.config.Name)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if messageType(buf[0]) != aliveMsg {
+		t.Fatalf("bad: %v", buf[0])
+	}
+
+	// It should match what went out for the broadcast.
+	queued := m.broadcasts.bcQueue[0].b.Message()
+	if !bytes.Equal(buf, queued) {
+		t.Fatalf("bad: %v != %v", buf, queued)
+	}
+
+	var a alive
+	if err := decode(buf[1:], &a); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if a.Node != m.config.Name || a.Incarnation != 1 {
+		t.Fatalf("bad: %#v", a)
+	}
+}
+
+func TestMemberList_IsAlone(t *testing.T) {
+	m := &Memberlist{config: &Config{Name: "test"}}
+	m.nodes = []*nodeState{
+		&nodeState{Node: Node{Name: "test"}, State: stateAlive},
+		&nodeState{Node: Node{Name: "test2"}, State: stateDead},
+	}
+	if !m.IsAlone() {
+		t.Fatalf("should be alone")
+	}
+
+	m.nodes = append(m.nodes, &nodeState{Node: Node{Name: "test3"}, State: stateSuspect})
+	if m.IsAlone() {
+		t.Fatalf("should not be alone")
+	}
 }
 
 func TestMemberlist_Join(t *testing.T) {
@@ -653,6 +1079,34 @@ func TestMemberlist_Join_protocolVersions(t *testing.T) {
 	}
 }
 
+func TestMemberlist_EstimatedDetectionTime(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	m.config.ProbeInterval = time.Second
+	m.config.GossipInterval = 200 * time.Millisecond
+	m.config.SuspicionMult = 4
+	m.config.SuspicionMaxTimeoutMult = 6
+	m.config.RetransmitMult = 4
+	m.setAlive()
+
+	// On our own there's no one to confirm, so the suspicion timeout is
+	// just the min.
+	if est := m.EstimatedDetectionTime(); est != 5800*time.Millisecond {
+		t.Fatalf("bad: %v", est)
+	}
+
+	for i := 0; i < 9; i++ {
+		a := alive{Node: fmt.Sprintf("test%d", i), Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+		m.aliveNode(&a, nil, false)
+	}
+
+	// 9s for the rotation, 1s for the probe, 24s for suspicion and 1.6s
+	// to retransmit.
+	if est := m.EstimatedDetectionTime(); est != 35600*time.Millisecond {
+		t.Fatalf("bad: %v", est)
+	}
+}
+
 func TestMemberlist_Leave(t *testing.T) {
 	m1 := GetMemberlist(t)
 	m1.setAlive()
@@ -705,6 +1159,244 @@ func TestMemberlist_Leave(t *testing.T) {
 	}
 }
 
+func TestMemberlist_Refresh(t *testing.T) {
+	m1 := GetMemberlist(t)
+	m1.setAlive()
+	defer m1.Shutdown()
+
+	// Create a second node, neither of them is scheduled so the only way
+	// the refresh can get through is via the direct send.
+	c := DefaultLANConfig()
+	addr1 := getBindAddr()
+	c.Name = addr1.String()
+	c.BindAddr = addr1.String()
+	c.BindPort = m1.config.BindPort
+
+	m2, err := newMemberlist(c)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	m2.setAlive()
+	defer m2.Shutdown()
+
+	num, err := m2.Join([]string{m1.config.BindAddr})
+	if num != 1 {
+		t.Fatalf("unexpected 1: %d", num)
+	}
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+
+	m2.nodeLock.RLock()
+	before := m2.nodeMap[c.Name].Incarnation
+	m2.nodeLock.RUnlock()
+
+	m2.Refresh()
+
+	retry(t, 10, 10*time.Millisecond, func(failf func(string, ...interface{})) {
+		m1.nodeLock.RLock()
+		remote := m1.nodeMap[c.Name].Incarnation
+		m1.nodeLock.RUnlock()
+
+		m2.nodeLock.RLock()
+		local := m2.nodeMap[c.Name].Incarnation
+		m2.nodeLock.RUnlock()
+
+		if local <= before {
+			failf("incarnation not bumped: %d", local)
+		}
+		if remote != local {
+			failf("incarnation mismatch: %d != %d", remote, local)
+		}
+	})
+}
+
+func TestMemberlist_Refresh_NotAlive(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	// We haven't added ourselves yet, so this should be a no-op instead of
+	// a panic.
+	m.Refresh()
+	if num := m.NumMembers(); num != 0 {
+		t.Fatalf("bad: %d", num)
+	}
+}
+
+func TestMemberlist_VerifyJoined(t *testing.T) {
+	m1 := GetMemberlist(t)
+	m1.setAlive()
+	defer m1.Shutdown()
+
+	if err := m1.VerifyJoined(100 * time.Millisecond); err == nil {
+		t.Fatalf("should fail with no peers")
+	}
+
+	c := DefaultLANConfig()
+	addr1 := getBindAddr()
+	c.Name = addr1.String()
+	c.BindAddr = addr1.String()
+	c.BindPort = m1.config.BindPort
+
+	m2, err := newMemberlist(c)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	m2.setAlive()
+	defer m2.Shutdown()
+
+	// Teach m1 about m2 without m2 learning about m1, which is what a
+	// one-way join looks like.
+	a := alive{
+		Node:        c.Name,
+		Addr:        addr1,
+		Port:        uint16(m1.config.BindPort),
+		Incarnation: 1,
+		Vsn: []uint8{
+			ProtocolVersionMin,
+			ProtocolVersionMax,
+			m1.config.ProtocolVersion,
+			m1.config.DelegateProtocolMin,
+			m1.config.DelegateProtocolMax,
+			m1.config.DelegateProtocolVersion,
+		},
+	}
+	m1.aliveNode(&a, nil, false)
+	if err := m1.VerifyJoined(time.Second); err == nil {
+		t.Fatalf("should fail when the peer doesn't know us")
+	}
+
+	num, err := m2.Join([]string{m1.config.BindAddr})
+	if num != 1 {
+		t.Fatalf("unexpected 1: %d", num)
+	}
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if err := m1.VerifyJoined(time.Second); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if err := m2.VerifyJoined(time.Second); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+}
+
+func TestMemberlist_ReceiveWorkers(t *testing.T) {
+	c1 := testConfig()
+	c1.ReceiveWorkers = 4
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.BindPort = m1.config.BindPort
+	c2.ReceiveWorkers = 4
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	num, err := m2.Join([]string{m1.config.BindAddr})
+	if num != 1 {
+		t.Fatalf("unexpected 1: %d", num)
+	}
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+
+	// Pings are handled over UDP, so they exercise the workers.
+	for i := 0; i < 10; i++ {
+		if _, err := m2.Ping(c1.Name, &net.UDPAddr{IP: net.ParseIP(c1.BindAddr), Port: m1.config.BindPort}); err != nil {
+			t.Fatalf("unexpected err: %s", err)
+		}
+	}
+}
+
+func TestMemberlist_MetricSink(t *testing.T) {
+	sink1 := metrics.NewInmemSink(time.Minute, time.Minute)
+	c1 := testConfig()
+	c1.MetricSink = sink1
+	m1, err := NewMemberlistOnOpenPort(c1)
+	if err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	defer m1.Shutdown()
+
+	sink2 := metrics.NewInmemSink(time.Minute, time.Minute)
+	c2 := testConfig()
+	c2.MetricSink = sink2
+	m2, err := NewMemberlistOnOpenPort(c2)
+	if err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	defer m2.Shutdown()
+
+	has := func(sink *metrics.InmemSink, key string) bool {
+		for _, intv := range sink.Data() {
+			if _, ok := intv.Counters[key]; ok {
+				return true
+			}
+			if _, ok := intv.Gauges[key]; ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Only the memberlist that did the work should report it.
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+	m1.aliveNode(&a, nil, false)
+	m1.awareness.ApplyDelta(1)
+	for _, key := range []string{"memberlist.msg.alive", "memberlist.health.score"} {
+		if !has(sink1, key) {
+			t.Fatalf("missing %q", key)
+		}
+		if has(sink2, key) {
+			t.Fatalf("unexpected %q", key)
+		}
+	}
+}
+
+func TestMemberlist_AdvertiseAddrFunc(t *testing.T) {
+	c1 := testConfig()
+	var dests []string
+	c1.AdvertiseAddrFunc = func(dest net.IP) net.IP {
+		dests = append(dests, dest.String())
+		return net.ParseIP("10.0.0.1")
+	}
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.BindPort = m1.config.BindPort
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	if _, err := m2.Join([]string{m1.config.BindAddr}); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+
+	// m2 should have been told about the custom address.
+	m2.nodeLock.RLock()
+	addr := m2.nodeMap[c1.Name].Addr
+	m2.nodeLock.RUnlock()
+	if addr.String() != "10.0.0.1" {
+		t.Fatalf("bad: %s", addr)
+	}
+	if len(dests) != 1 {
+		t.Fatalf("bad: %v", dests)
+	}
+}
+
 func TestMemberlist_JoinShutdown(t *testing.T) {
 	m1 := GetMemberlist(t)
 	m1.setAlive()
@@ -891,6 +1583,49 @@ func TestMemberlist_delegateMeta_Update(t *testing.T) {
 	}
 }
 
+func TestMemberlist_UpdateMetaAndWait(t *testing.T) {
+	c1 := testConfig()
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.BindPort = m1.config.BindPort
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	if _, err := m2.Join([]string{c1.BindAddr}); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+
+	if err := m2.UpdateMetaAndWait([]byte("new"), 1, 5*time.Second); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+
+	// Once it returns, the peer must already have the new meta.
+	m1.nodeLock.RLock()
+	meta := string(m1.nodeMap[c2.Name].Meta)
+	m1.nodeLock.RUnlock()
+	if meta != "new" {
+		t.Fatalf("bad meta: %q", meta)
+	}
+
+	// There's only one peer, so two can never confirm.
+	err = m2.UpdateMetaAndWait([]byte("newer"), 2, 100*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "Timed out") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	if err := m2.UpdateMetaAndWait(make([]byte, MetaMaxSize+1), 0, time.Second); err == nil {
+		t.Fatalf("expected error for oversized meta")
+	}
+}
+
 func TestMemberlist_UserData(t *testing.T) {
 	m1, d1 := GetMemberlistDelegate(t)
 	d1.state = []byte("something")
@@ -952,6 +1687,48 @@ func TestMemberlist_UserData(t *testing.T) {
 	}
 }
 
+func TestMemberlist_SendBestEffort_TooLarge(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	to := &Node{Name: "test", Addr: net.IPv4(127, 0, 0, 1), Port: 7946}
+	msg := make([]byte, m.config.UDPBufferSize)
+	if err := m.SendBestEffort(to, msg); err == nil {
+		t.Fatalf("expected error for an oversized message")
+	}
+	if err := m.SendTo(&net.UDPAddr{IP: to.Addr, Port: 7946}, msg); err == nil {
+		t.Fatalf("expected error for an oversized message")
+	}
+}
+
+func TestMemberlist_SendBestEffort_TooLargeEncrypted(t *testing.T) {
+	c := testConfig()
+	c.SecretKey = make([]byte, 16)
+	m, err := NewMemberlistOnOpenPort(c)
+	if err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	defer m.Shutdown()
+
+	// This would fit if it weren't for the encryption overhead.
+	to := &Node{Name: "test", Addr: net.IPv4(127, 0, 0, 1), Port: 7946}
+	msg := make([]byte, m.config.UDPBufferSize-1-crcHeaderOverhead)
+	if err := m.SendBestEffort(to, msg); err == nil {
+		t.Fatalf("expected error for an oversized message")
+	}
+
+	// It needs to leave room for the CRC header as well.
+	msg = make([]byte, m.config.UDPBufferSize-1-encryptOverhead(m.encryptionVersion()))
+	if err := m.SendBestEffort(to, msg); err == nil {
+		t.Fatalf("expected error for an oversized message")
+	}
+
+	msg = make([]byte, m.config.UDPBufferSize-1-m.packetOverhead())
+	if err := m.SendBestEffort(to, msg); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestMemberlist_SendTo(t *testing.T) {
 	m1, d1 := GetMemberlistDelegate(t)
 	m1.setAlive()
@@ -1253,6 +2030,87 @@ func TestMemberlist_conflictDelegate(t *testing.T) {
 	}
 }
 
+func TestMemberlist_JoinAndWait(t *testing.T) {
+	c1 := testConfig()
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.BindPort = m1.config.BindPort
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	if err := m2.JoinAndWait([]string{c1.BindAddr}, 2, time.Second); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+
+	// There aren't enough nodes to ever get to 3.
+	start := time.Now()
+	err = m2.JoinAndWait([]string{c1.BindAddr}, 3, 100*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("bad: %v", err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Fatalf("should have waited")
+	}
+
+	// A failed join should be reported as such.
+	c3 := testConfig()
+	c3.BindPort = m1.config.BindPort
+	c3.TCPTimeout = 10 * time.Millisecond
+	m3, err := Create(c3)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	defer m3.Shutdown()
+	err = m3.JoinAndWait([]string{getBindAddr().String()}, 1, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "Failed to join") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestMemberlist_Join_NameConflict(t *testing.T) {
+	c1 := testConfig()
+	c2 := testConfig()
+
+	// Ensure name conflict
+	c2.Name = c1.Name
+
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	num, err := m2.Join([]string{c1.BindAddr})
+	if num != 0 {
+		t.Fatalf("unexpected 0: %d", num)
+	}
+	if err != ErrNameConflict {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A node with the same ID is considered an older version of us.
+	m1.config.ID = "id1"
+	m1.UpdateNode(0)
+	m2.config.ID = "id1"
+	if _, err := m2.Join([]string{c1.BindAddr}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
 type MockPing struct {
 	other   *Node
 	rtt     time.Duration
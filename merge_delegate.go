@@ -12,3 +12,27 @@ type MergeDelegate interface {
 	// the return value is non-nil, the merge is canceled.
 	NotifyMerge(peers []*Node) error
 }
+
+// MergeResolver can optionally be implemented by a MergeDelegate to settle
+// conflicts when merging state from a peer during a push/pull, which would
+// otherwise be settled by the incarnation number alone. Unlike NotifyMerge,
+// this is also invoked as part of the push-pull anti-entropy.
+type MergeResolver interface {
+	// ResolveMerge is invoked when the peer's view of a node has the same
+	// incarnation number as ours, but a different state. Return true to
+	// adopt the peer's view, or false to keep ours. A dead node can only
+	// come back with an alive message, so adopting a suspect view over a
+	// dead one leaves the node dead. The Node arguments must not be
+	// modified.
+	ResolveMerge(local, remote *Node, localStatus, remoteStatus NodeStatus) bool
+}
+
+// NodeStatus is the state of a node as handed to a MergeResolver. The
+// values line up with nodeStateType so one can be converted to the other.
+type NodeStatus int
+
+const (
+	StatusAlive NodeStatus = iota
+	StatusSuspect
+	StatusDead
+)
@@ -0,0 +1,62 @@
+package memberlist
+
+import (
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+// globalSink is a metrics.MetricSink that passes everything on to the global
+// go-metrics functions. This is used when no sink is configured, so metrics
+// still end up wherever metrics.NewGlobal was pointed.
+type globalSink struct{}
+
+func (globalSink) SetGauge(key []string, val float32) {
+	metrics.SetGauge(key, val)
+}
+
+func (globalSink) SetGaugeWithLabels(key []string, val float32, labels []metrics.Label) {
+	metrics.SetGaugeWithLabels(key, val, labels)
+}
+
+func (globalSink) EmitKey(key []string, val float32) {
+	metrics.EmitKey(key, val)
+}
+
+func (globalSink) IncrCounter(key []string, val float32) {
+	metrics.IncrCounter(key, val)
+}
+
+func (globalSink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
+	metrics.IncrCounterWithLabels(key, val, labels)
+}
+
+func (globalSink) AddSample(key []string, val float32) {
+	metrics.AddSample(key, val)
+}
+
+func (globalSink) AddSampleWithLabels(key []string, val float32, labels []metrics.Label) {
+	metrics.AddSampleWithLabels(key, val, labels)
+}
+
+// metricSinkOrGlobal returns the given sink, or one that goes to the global
+// go-metrics functions if it's nil.
+func metricSinkOrGlobal(sink metrics.MetricSink) metrics.MetricSink {
+	if sink == nil {
+		return globalSink{}
+	}
+	return sink
+}
+
+// metricSink returns the sink to send metrics to, see Config.MetricSink.
+func (m *Memberlist) metricSink() metrics.MetricSink {
+	return metricSinkOrGlobal(m.config.MetricSink)
+}
+
+// measureSince adds a sample to the sink for the time elapsed since start, in
+// milliseconds, like metrics.MeasureSince does for the global sink.
+func measureSince(sink metrics.MetricSink, key []string, start time.Time) {
+	elapsed := time.Now().Sub(start)
+	msec := float32(elapsed.Nanoseconds()) / float32(time.Millisecond)
+	sink.AddSample(key, msec)
+}
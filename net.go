@@ -7,11 +7,11 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io"
+	"math/rand"
 	"net"
 	"sync/atomic"
 	"time"
 
-	metrics "github.com/armon/go-metrics"
 	"github.com/hashicorp/go-msgpack/codec"
 )
 
@@ -71,6 +71,7 @@ const (
 	compoundHeaderOverhead = 2   // Assumed header overhead
 	compoundOverhead       = 2   // Assumed overhead per entry in compoundHeader
 	userMsgOverhead        = 1
+	crcHeaderOverhead      = 5                     // Header rawSendMsgPacket adds for the CRC
 	blockingWarning        = 10 * time.Millisecond // Warn if a UDP packet takes this long to process
 	maxPushStateBytes      = 20 * 1024 * 1024
 	maxPushPullRequests    = 128 // Maximum number of concurrent push/pull requests
@@ -84,6 +85,15 @@ type ping struct {
 	// the intended recipient. This is to protect again an agent
 	// restart with a new name.
 	Node string
+
+	// Member is optionally sent to ask the target whether it has the
+	// given node in its member list. The answer is sent back as the ack
+	// payload, see memberKnownPayload.
+	Member string `codec:",omitempty"`
+
+	// MemberIncarnation optionally goes along with Member, to ask if the
+	// target has seen at least this incarnation of the given node.
+	MemberIncarnation uint32 `codec:",omitempty"`
 }
 
 // indirect ping sent to an indirect ndoe
@@ -125,6 +135,7 @@ type suspect struct {
 type alive struct {
 	Incarnation uint32
 	Node        string
+	ID          string
 	Addr        []byte
 	Port        uint16
 	Meta        []byte
@@ -159,6 +170,7 @@ type userMsgHeader struct {
 // transferring out node states
 type pushNodeState struct {
 	Name        string
+	ID          string
 	Addr        []byte
 	Port        uint16
 	Meta        []byte
@@ -197,7 +209,23 @@ func (m *Memberlist) streamListen() {
 	for {
 		select {
 		case conn := <-m.transport.StreamCh():
-			go m.handleConn(conn)
+			if m.inboundStreams == nil {
+				go m.handleConn(conn)
+				continue
+			}
+
+			// Refuse the connection if we are already at the limit
+			select {
+			case m.inboundStreams <- struct{}{}:
+				go func() {
+					defer func() { <-m.inboundStreams }()
+					m.handleConn(conn)
+				}()
+			default:
+				m.metricSink().IncrCounter([]string{"memberlist", "tcp", "refused"}, 1)
+				m.logger.Printf("[WARN] memberlist: Too many inbound streams, refusing %s", LogConn(conn))
+				conn.Close()
+			}
 
 		case <-m.shutdownCh:
 			return
@@ -210,7 +238,7 @@ func (m *Memberlist) handleConn(conn net.Conn) {
 	m.logger.Printf("[DEBUG] memberlist: Stream connection %s", LogConn(conn))
 
 	defer conn.Close()
-	metrics.IncrCounter([]string{"memberlist", "tcp", "accept"}, 1)
+	m.metricSink().IncrCounter([]string{"memberlist", "tcp", "accept"}, 1)
 
 	conn.SetDeadline(time.Now().Add(m.config.TCPTimeout))
 	msgType, bufConn, dec, err := m.readStream(conn)
@@ -327,6 +355,11 @@ func (m *Memberlist) ingestPacket(buf []byte, from net.Addr, timestamp time.Time
 		buf = plain
 	}
 
+	// See if we're hearing from a node we think is dead
+	if m.config.ReviveOnContact {
+		m.checkRevive(from)
+	}
+
 	// See if there's a checksum included to verify the contents of the message
 	if len(buf) >= 5 && messageType(buf[0]) == hasCrcMsg {
 		crc := crc32.ChecksumIEEE(buf[5:])
@@ -480,7 +513,9 @@ func (m *Memberlist) handlePing(buf []byte, from net.Addr) {
 	}
 	var ack ackResp
 	ack.SeqNo = p.SeqNo
-	if m.config.Ping != nil {
+	if p.Member != "" {
+		ack.Payload = m.memberKnownPayload(p.Member, p.MemberIncarnation)
+	} else if m.config.Ping != nil {
 		ack.Payload = m.config.Ping.AckPayload()
 	}
 	if err := m.encodeAndSendMsg(from.String(), ackRespMsg, &ack); err != nil {
@@ -488,6 +523,21 @@ func (m *Memberlist) handlePing(buf []byte, from net.Addr) {
 	}
 }
 
+// memberKnownPayload returns the ack payload used to answer a ping asking
+// whether we have the given node in our member list, at the given incarnation
+// or later.
+func (m *Memberlist) memberKnownPayload(name string, inc uint32) []byte {
+	m.nodeLock.RLock()
+	state, ok := m.nodeMap[name]
+	known := ok && state.State != stateDead && m.compareIncarnation(state.Incarnation, inc) >= 0
+	m.nodeLock.RUnlock()
+
+	if known {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
 func (m *Memberlist) handleIndirectPing(buf []byte, from net.Addr) {
 	var ind indirectPingReq
 	if err := decode(buf, &ind); err != nil {
@@ -517,7 +567,10 @@ func (m *Memberlist) handleIndirectPing(buf []byte, from net.Addr) {
 			m.logger.Printf("[ERR] memberlist: Failed to forward ack: %s %s", err, LogAddress(from))
 		}
 	}
-	m.setAckHandler(localSeqNo, respHandler, m.config.ProbeTimeout)
+	if err := m.setAckHandler(localSeqNo, respHandler, m.config.ProbeTimeout); err != nil {
+		m.logger.Printf("[WARN] memberlist: Refusing indirect ping: %s %s", err, LogAddress(from))
+		return
+	}
 
 	// Send the ping.
 	addr := joinHostPort(net.IP(ind.Target).String(), ind.Port)
@@ -653,6 +706,18 @@ func (m *Memberlist) sendMsg(addr string, msg []byte) error {
 	return m.rawSendMsgPacket(addr, nil, compound.Bytes())
 }
 
+// packetOverhead returns how many bytes rawSendMsgPacket may add to a message
+// on its way out, which is the CRC header plus the encryption overhead if
+// we're encrypting. Anything checking that a message fits in a single packet
+// needs to leave room for this.
+func (m *Memberlist) packetOverhead() int {
+	overhead := crcHeaderOverhead
+	if m.config.EncryptionEnabled() && m.config.GossipVerifyOutgoing {
+		overhead += encryptOverhead(m.encryptionVersion())
+	}
+	return overhead
+}
+
 // rawSendMsgPacket is used to send message via packet to another host without
 // modification, other than compression or encryption if enabled.
 func (m *Memberlist) rawSendMsgPacket(addr string, node *Node, msg []byte) error {
@@ -707,11 +772,38 @@ func (m *Memberlist) rawSendMsgPacket(addr string, node *Node, msg []byte) error
 		msg = buf.Bytes()
 	}
 
-	metrics.IncrCounter([]string{"memberlist", "udp", "sent"}, float32(len(msg)))
+	// Hold the packet back if we've been asked to simulate a slow link.
+	if delay := m.chaosDelay(addr); delay > 0 {
+		time.AfterFunc(delay, func() {
+			if m.hasShutdown() {
+				return
+			}
+			m.metricSink().IncrCounter([]string{"memberlist", "udp", "sent"}, float32(len(msg)))
+			if _, err := m.transport.WriteTo(msg, addr); err != nil {
+				m.logger.Printf("[ERR] memberlist: Failed to send delayed packet to %s: %v", addr, err)
+			}
+		})
+		return nil
+	}
+
+	m.metricSink().IncrCounter([]string{"memberlist", "udp", "sent"}, float32(len(msg)))
 	_, err := m.transport.WriteTo(msg, addr)
 	return err
 }
 
+// chaosDelay returns how long to hold back a packet to the given address, as
+// decided by ChaosDelayFunc.
+func (m *Memberlist) chaosDelay(addr string) time.Duration {
+	if m.config.ChaosDelayFunc == nil {
+		return 0
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0
+	}
+	return m.config.ChaosDelayFunc(net.ParseIP(host))
+}
+
 // rawSendMsgStream is used to stream a message to another host without
 // modification, other than applying compression and encryption if enabled.
 func (m *Memberlist) rawSendMsgStream(conn net.Conn, sendBuf []byte) error {
@@ -720,7 +812,8 @@ func (m *Memberlist) rawSendMsgStream(conn net.Conn, sendBuf []byte) error {
 		compBuf, err := compressPayload(sendBuf)
 		if err != nil {
 			m.logger.Printf("[ERROR] memberlist: Failed to compress payload: %v", err)
-		} else {
+		} else if compBuf.Len() < len(sendBuf) {
+			// Only use compression if it reduced the size
 			sendBuf = compBuf.Bytes()
 		}
 	}
@@ -736,7 +829,7 @@ func (m *Memberlist) rawSendMsgStream(conn net.Conn, sendBuf []byte) error {
 	}
 
 	// Write out the entire send buffer
-	metrics.IncrCounter([]string{"memberlist", "tcp", "sent"}, float32(len(sendBuf)))
+	m.metricSink().IncrCounter([]string{"memberlist", "tcp", "sent"}, float32(len(sendBuf)))
 
 	if n, err := conn.Write(sendBuf); err != nil {
 		return err
@@ -782,7 +875,7 @@ func (m *Memberlist) sendAndReceiveState(addr string, join bool) ([]pushNodeStat
 	}
 	defer conn.Close()
 	m.logger.Printf("[DEBUG] memberlist: Initiating push/pull sync with: %s", conn.RemoteAddr())
-	metrics.IncrCounter([]string{"memberlist", "tcp", "connect"}, 1)
+	m.metricSink().IncrCounter([]string{"memberlist", "tcp", "connect"}, 1)
 
 	// Send our state
 	if err := m.sendLocalState(conn, join); err != nil {
@@ -814,17 +907,50 @@ func (m *Memberlist) sendAndReceiveState(addr string, join bool) ([]pushNodeStat
 	return remoteNodes, userState, err
 }
 
+// samplePushPullNodes returns a random sample of k of the given nodes, making
+// sure the named local node is part of it. The given slice is reordered.
+func samplePushPullNodes(r *rand.Rand, nodes []pushNodeState, k int, local string) []pushNodeState {
+	start := 0
+	for i := range nodes {
+		if nodes[i].Name == local {
+			nodes[0], nodes[i] = nodes[i], nodes[0]
+			start = 1
+			break
+		}
+	}
+
+	// Do a partial shuffle to pick the rest
+	for i := start; i < k; i++ {
+		j := i + r.Intn(len(nodes)-i)
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	}
+	return nodes[:k]
+}
+
 // sendLocalState is invoked to send our local state over a stream connection.
 func (m *Memberlist) sendLocalState(conn net.Conn, join bool) error {
 	// Setup a deadline
 	conn.SetDeadline(time.Now().Add(m.config.TCPTimeout))
 
+	// Figure out who we're talking to, in case we advertise a different
+	// address to them.
+	var dest net.IP
+	if m.config.AdvertiseAddrFunc != nil {
+		if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+			dest = net.ParseIP(host)
+		}
+	}
+
 	// Prepare the local node state
 	m.nodeLock.RLock()
 	localNodes := make([]pushNodeState, len(m.nodes))
 	for idx, n := range m.nodes {
 		localNodes[idx].Name = n.Name
+		localNodes[idx].ID = n.ID
 		localNodes[idx].Addr = n.Addr
+		if n.Name == m.config.Name {
+			localNodes[idx].Addr = m.advertiseAddrFor(dest, n.Addr)
+		}
 		localNodes[idx].Port = n.Port
 		localNodes[idx].Incarnation = n.Incarnation
 		localNodes[idx].State = n.State
@@ -836,6 +962,11 @@ func (m *Memberlist) sendLocalState(conn net.Conn, join bool) error {
 	}
 	m.nodeLock.RUnlock()
 
+	// Only send a sample of the nodes if there are too many
+	if max := m.config.MaxPushPullNodes; max > 0 && !join && len(localNodes) > max {
+		localNodes = samplePushPullNodes(m.rng, localNodes, max, m.config.Name)
+	}
+
 	// Get the delegate state
 	var userData []byte
 	if m.config.Delegate != nil {
@@ -872,6 +1003,7 @@ func (m *Memberlist) sendLocalState(conn net.Conn, join bool) error {
 	}
 
 	// Get the send buffer
+	m.metricSink().IncrCounter([]string{"memberlist", "pushPull", "sent"}, float32(bufConn.Len()))
 	return m.rawSendMsgStream(conn, bufConn.Bytes())
 }
 
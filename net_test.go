@@ -5,9 +5,11 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -552,6 +554,107 @@ func TestTCPPushPull(t *testing.T) {
 	}
 }
 
+func TestMaxInboundStreams(t *testing.T) {
+	c1 := testConfig()
+	c1.MaxInboundStreams = 1
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.BindPort = m1.config.BindPort
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	// Tie up the only slot with an idle connection.
+	addr := net.JoinHostPort(c1.BindAddr, strconv.Itoa(m1.config.BindPort))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if _, err := m2.Join([]string{c1.BindAddr}); err == nil {
+		t.Fatalf("should fail to join")
+	}
+
+	// Once the slot is freed up the join should go through.
+	conn.Close()
+	retry(t, 10, 10*time.Millisecond, func(failf func(string, ...interface{})) {
+		if _, err := m2.Join([]string{c1.BindAddr}); err != nil {
+			failf("unexpected err: %s", err)
+		}
+	})
+}
+
+func TestStreamKeepAlive(t *testing.T) {
+	c1 := testConfig()
+	c1.StreamKeepAlive = time.Second
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.BindPort = m1.config.BindPort
+	c2.StreamKeepAlive = time.Second
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	// Push/pull runs over streams, which should work as usual with
+	// keep-alives turned on at both ends.
+	if _, err := m2.Join([]string{c1.BindAddr}); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if num := m1.NumMembers(); num != 2 {
+		t.Fatalf("bad: %d", num)
+	}
+
+	// Make sure the keep-alive period actually makes it to the dialer.
+	nt, ok := m2.transport.(*NetTransport)
+	if !ok {
+		t.Fatalf("bad: %T", m2.transport)
+	}
+	d := nt.dialer(time.Second)
+	if d.KeepAlive != c2.StreamKeepAlive || d.Timeout != time.Second {
+		t.Fatalf("bad: %v", d)
+	}
+}
+
+func TestSamplePushPullNodes(t *testing.T) {
+	for trial := 0; trial < 10; trial++ {
+		var nodes []pushNodeState
+		for i := 0; i < 100; i++ {
+			nodes = append(nodes, pushNodeState{Name: fmt.Sprintf("node%d", i)})
+		}
+
+		sample := samplePushPullNodes(newRand(0), nodes, 10, "node42")
+		if len(sample) != 10 {
+			t.Fatalf("bad: %d", len(sample))
+		}
+
+		seen := make(map[string]bool)
+		for _, n := range sample {
+			if seen[n.Name] {
+				t.Fatalf("duplicate: %s", n.Name)
+			}
+			seen[n.Name] = true
+		}
+		if !seen["node42"] {
+			t.Fatalf("missing local node: %v", sample)
+		}
+	}
+}
+
 func TestSendMsg_Piggyback(t *testing.T) {
 	m := GetMemberlist(t)
 	defer m.Shutdown()
@@ -673,6 +776,44 @@ func TestEncryptDecryptState(t *testing.T) {
 	}
 }
 
+func TestRawSendMsgStream_Compression(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	m.config.EnableCompression = true
+
+	send := func(msg []byte) []byte {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- m.rawSendMsgStream(client, msg)
+		}()
+		buf := make([]byte, 2*len(msg)+64)
+		n, err := server.Read(buf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return buf[:n]
+	}
+
+	// Small messages grow when compressed, so they go out as is.
+	small := []byte{byte(userMsg), 'h', 'i'}
+	if out := send(small); !bytes.Equal(out, small) {
+		t.Fatalf("expected uncompressed message, got %v", out)
+	}
+
+	// Large repetitive ones shrink, so they get compressed.
+	large := append([]byte{byte(userMsg)}, bytes.Repeat([]byte("state"), 200)...)
+	if out := send(large); messageType(out[0]) != compressMsg || len(out) >= len(large) {
+		t.Fatalf("expected compressed message, got %d bytes", len(out))
+	}
+}
+
 func TestRawSendUdp_CRC(t *testing.T) {
 	m := GetMemberlist(t)
 	m.config.EnableCompression = false
@@ -812,3 +953,60 @@ func TestGossip_MismatchedKeys(t *testing.T) {
 		t.Fatalf("bad: %s", err)
 	}
 }
+
+func BenchmarkIngestPacket_ReceiveWorkers(b *testing.B) {
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			benchmarkReceiveWorkers(b, workers)
+		})
+	}
+}
+
+// benchmarkReceiveWorkers measures how many encrypted pings per second a
+// memberlist with the given number of receive workers can answer.
+func benchmarkReceiveWorkers(b *testing.B, workers int) {
+	key := make([]byte, 16)
+	network := &MockNetwork{}
+	sender := network.NewTransport()
+	receiver := network.NewTransport()
+
+	c := DefaultLANConfig()
+	c.Name = "receiver"
+	c.Transport = receiver
+	c.SecretKey = key
+	c.ReceiveWorkers = workers
+	c.LogOutput = ioutil.Discard
+	m, err := newMemberlist(c)
+	if err != nil {
+		b.Fatalf("failed to start: %v", err)
+	}
+	defer m.Shutdown()
+
+	msg, err := encode(pingMsg, ping{SeqNo: 42})
+	if err != nil {
+		b.Fatalf("unexpected err %s", err)
+	}
+	var buf bytes.Buffer
+	if err := encryptPayload(m.encryptionVersion(), key, msg.Bytes(), nil, &buf); err != nil {
+		b.Fatalf("unexpected err %s", err)
+	}
+	packet := buf.Bytes()
+
+	// Count the acks coming back so we know every ping was handled.
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		for i := 0; i < b.N; i++ {
+			<-sender.PacketCh()
+		}
+	}()
+
+	b.SetBytes(int64(len(packet)))
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			sender.WriteTo(packet, receiver.addr.String())
+		}
+	}()
+	<-doneCh
+}
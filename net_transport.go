@@ -33,6 +33,19 @@ type NetTransportConfig struct {
 
 	// Logger is a logger for operator messages.
 	Logger *log.Logger
+
+	// ReceiveWorkers is the number of goroutines reading from each UDP
+	// listener. If this is zero, a single goroutine is used.
+	ReceiveWorkers int
+
+	// StreamKeepAlive is the TCP keep-alive period to use for stream
+	// connections, both dialed and accepted. If this is zero, the OS and Go
+	// runtime defaults are used.
+	StreamKeepAlive time.Duration
+
+	// MetricSink is where metrics are sent. If this is nil, the global
+	// go-metrics sink is used.
+	MetricSink metrics.MetricSink
 }
 
 // NetTransport is a Transport implementation that uses connectionless UDP for
@@ -42,6 +55,7 @@ type NetTransport struct {
 	packetCh     chan *Packet
 	streamCh     chan net.Conn
 	logger       *log.Logger
+	metricSink   metrics.MetricSink
 	wg           sync.WaitGroup
 	tcpListeners []*net.TCPListener
 	udpListeners []*net.UDPConn
@@ -60,10 +74,11 @@ func NewNetTransport(config *NetTransportConfig) (*NetTransport, error) {
 	// Build out the new transport.
 	var ok bool
 	t := NetTransport{
-		config:   config,
-		packetCh: make(chan *Packet),
-		streamCh: make(chan net.Conn),
-		logger:   config.Logger,
+		config:     config,
+		packetCh:   make(chan *Packet),
+		streamCh:   make(chan net.Conn),
+		logger:     config.Logger,
+		metricSink: metricSinkOrGlobal(config.MetricSink),
 	}
 
 	// Clean up listeners if there's an error.
@@ -104,10 +119,16 @@ func NewNetTransport(config *NetTransportConfig) (*NetTransport, error) {
 	}
 
 	// Fire them up now that we've been able to create them all.
+	workers := config.ReceiveWorkers
+	if workers < 1 {
+		workers = 1
+	}
 	for i := 0; i < len(config.BindAddrs); i++ {
-		t.wg.Add(2)
+		t.wg.Add(1 + workers)
 		go t.tcpListen(t.tcpListeners[i])
-		go t.udpListen(t.udpListeners[i])
+		for j := 0; j < workers; j++ {
+			go t.udpListen(t.udpListeners[i])
+		}
 	}
 
 	ok = true
@@ -190,8 +211,13 @@ func (t *NetTransport) PacketCh() <-chan *Packet {
 
 // See Transport.
 func (t *NetTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
-	dialer := net.Dialer{Timeout: timeout}
-	return dialer.Dial("tcp", addr)
+	return t.dialer(timeout).Dial("tcp", addr)
+}
+
+// dialer returns the dialer to use for outgoing stream connections, which
+// sets up keep-alives according to StreamKeepAlive.
+func (t *NetTransport) dialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{Timeout: timeout, KeepAlive: t.config.StreamKeepAlive}
 }
 
 // See Transport.
@@ -232,6 +258,14 @@ func (t *NetTransport) tcpListen(tcpLn *net.TCPListener) {
 			continue
 		}
 
+		if t.config.StreamKeepAlive > 0 {
+			if err := conn.SetKeepAlive(true); err != nil {
+				t.logger.Printf("[WARN] memberlist: Failed to enable TCP keep-alive: %v", err)
+			} else if err := conn.SetKeepAlivePeriod(t.config.StreamKeepAlive); err != nil {
+				t.logger.Printf("[WARN] memberlist: Failed to set TCP keep-alive period: %v", err)
+			}
+		}
+
 		t.streamCh <- conn
 	}
 }
@@ -264,7 +298,7 @@ func (t *NetTransport) udpListen(udpLn *net.UDPConn) {
 		}
 
 		// Ingest the packet.
-		metrics.IncrCounter([]string{"memberlist", "udp", "received"}, float32(n))
+		t.metricSink.IncrCounter([]string{"memberlist", "udp", "received"}, float32(n))
 		t.packetCh <- &Packet{
 			Buf:       buf[:n],
 			From:      addr,
@@ -0,0 +1,66 @@
+package memberlist
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// ProbeTrace is a step by step record of a single probe of a node, which is
+// handy for working out after the fact why a node was suspected. These are
+// only collected when TraceProbes is enabled.
+type ProbeTrace struct {
+	Node  string
+	Start time.Time
+	Steps []ProbeStep
+}
+
+// ProbeStep is a single step of a probe, such as sending the direct ping or
+// timing out waiting for the indirect acks. The Detail depends on the Event,
+// for example it's the round trip time of an "ack", or the relay used for an
+// "indirect-sent".
+type ProbeStep struct {
+	Time   time.Time
+	Event  string
+	Detail string
+}
+
+// step adds a step to the trace. This is a no-op on a nil trace, so callers
+// don't need to check whether tracing is enabled.
+func (t *ProbeTrace) step(event, detail string) {
+	if t == nil {
+		return
+	}
+	t.Steps = append(t.Steps, ProbeStep{time.Now(), event, detail})
+}
+
+// String formats the trace on a single line, with each step's offset from the
+// start of the probe, which is suitable for logging.
+func (t *ProbeTrace) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "probe of %s:", t.Node)
+	for _, s := range t.Steps {
+		fmt.Fprintf(&buf, " [+%s %s", s.Time.Sub(t.Start), s.Event)
+		if s.Detail != "" {
+			fmt.Fprintf(&buf, " %s", s.Detail)
+		}
+		buf.WriteString("]")
+	}
+	return buf.String()
+}
+
+// sendProbeTrace hands a finished trace to the ProbeTraceCh, or logs it if
+// there's no channel. Traces are dropped rather than holding up probing if
+// the channel is full.
+func (m *Memberlist) sendProbeTrace(trace *ProbeTrace) {
+	if m.config.ProbeTraceCh == nil {
+		m.logger.Printf("[DEBUG] memberlist: Trace: %s", trace)
+		return
+	}
+
+	select {
+	case m.config.ProbeTraceCh <- trace:
+	default:
+		m.metricSink().IncrCounter([]string{"memberlist", "probe", "trace", "dropped"}, 1)
+	}
+}
@@ -19,6 +19,11 @@ type TransmitLimitedQueue struct {
 	// number of retransmissions attempted.
 	RetransmitMult int
 
+	// FixedRetransmits, if non-zero, is the exact number of times each
+	// message is transmitted, instead of scaling it with the cluster size
+	// using RetransmitMult.
+	FixedRetransmits int
+
 	sync.Mutex
 	bcQueue limitedBroadcasts
 }
@@ -77,7 +82,10 @@ func (q *TransmitLimitedQueue) GetBroadcasts(overhead, limit int) [][]byte {
 		return nil
 	}
 
-	transmitLimit := retransmitLimit(q.RetransmitMult, q.NumNodes())
+	transmitLimit := q.FixedRetransmits
+	if transmitLimit <= 0 {
+		transmitLimit = retransmitLimit(q.RetransmitMult, q.NumNodes())
+	}
 	bytesUsed := 0
 	var toSend [][]byte
 
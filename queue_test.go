@@ -95,6 +95,22 @@ func TestTransmitLimited_GetBroadcasts_Limit(t *testing.T) {
 	}
 }
 
+func TestTransmitLimited_GetBroadcasts_Fixed(t *testing.T) {
+	q := &TransmitLimitedQueue{RetransmitMult: 3, FixedRetransmits: 2, NumNodes: func() int { return 10 }}
+
+	q.QueueBroadcast(&memberlistBroadcast{"test", []byte("foo"), nil})
+
+	// Should be sent exactly twice, regardless of the cluster size
+	for i := 0; i < 2; i++ {
+		if all := q.GetBroadcasts(2, 80); len(all) != 1 {
+			t.Fatalf("missing messages: %v", all)
+		}
+	}
+	if q.NumQueued() != 0 {
+		t.Fatalf("bad len")
+	}
+}
+
 func TestTransmitLimited_Prune(t *testing.T) {
 	q := &TransmitLimitedQueue{RetransmitMult: 1, NumNodes: func() int { return 10 }}
 
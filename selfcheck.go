@@ -0,0 +1,60 @@
+package memberlist
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// selfCheck verifies our node state is consistent and reports any problems
+// it finds. This is run periodically if SelfCheckInterval is set.
+func (m *Memberlist) selfCheck() {
+	m.nodeLock.RLock()
+	problems := m.checkConsistency()
+	m.nodeLock.RUnlock()
+
+	if len(problems) == 0 {
+		return
+	}
+
+	m.metricSink().IncrCounter([]string{"memberlist", "selfcheck", "inconsistency"}, float32(len(problems)))
+	for _, problem := range problems {
+		m.logger.Printf("[WARN] memberlist: Inconsistent node state: %s", problem)
+	}
+	if m.config.OnInconsistency != nil {
+		m.config.OnInconsistency(problems)
+	}
+}
+
+// checkConsistency makes sure that the node list and the node map, which are
+// maintained side by side, agree with each other. It returns a description of
+// each problem found. This must be called while the nodeLock is held.
+func (m *Memberlist) checkConsistency() []string {
+	var problems []string
+
+	seen := make(map[string]struct{}, len(m.nodes))
+	for i, n := range m.nodes {
+		if _, ok := seen[n.Name]; ok {
+			problems = append(problems, fmt.Sprintf("node %s is in the node list more than once", n.Name))
+			continue
+		}
+		seen[n.Name] = struct{}{}
+
+		state, ok := m.nodeMap[n.Name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("node %s at index %d is missing from the node map", n.Name, i))
+		} else if state != n {
+			problems = append(problems, fmt.Sprintf("node %s at index %d doesn't match the node map", n.Name, i))
+		}
+	}
+
+	for name := range m.nodeMap {
+		if _, ok := seen[name]; !ok {
+			problems = append(problems, fmt.Sprintf("node %s is missing from the node list", name))
+		}
+	}
+
+	if num := int(atomic.LoadUint32(&m.numNodes)); num != len(m.nodes) {
+		problems = append(problems, fmt.Sprintf("node count is %d but there are %d nodes", num, len(m.nodes)))
+	}
+	return problems
+}
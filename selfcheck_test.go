@@ -0,0 +1,54 @@
+package memberlist
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMemberlist_SelfCheck(t *testing.T) {
+	var reported []string
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	m.config.OnInconsistency = func(problems []string) {
+		reported = append(reported, problems...)
+	}
+	m.setAlive()
+
+	for _, name := range []string{"test1", "test2"} {
+		a := alive{Node: name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+		m.aliveNode(&a, nil, false)
+	}
+
+	// Everything should line up to begin with.
+	m.selfCheck()
+	if len(reported) != 0 {
+		t.Fatalf("bad: %v", reported)
+	}
+
+	// Drop a node from the map but not the list, and vice versa.
+	m.nodeLock.Lock()
+	delete(m.nodeMap, "test1")
+	m.nodeMap["test3"] = &nodeState{Node: Node{Name: "test3"}}
+	m.nodeLock.Unlock()
+
+	var idx int
+	for i, n := range m.nodes {
+		if n.Name == "test1" {
+			idx = i
+		}
+	}
+
+	m.selfCheck()
+	expected := map[string]bool{
+		fmt.Sprintf("node test1 at index %d is missing from the node map", idx): true,
+		"node test3 is missing from the node list":                              true,
+	}
+	if len(reported) != 2 {
+		t.Fatalf("bad: %v", reported)
+	}
+	for _, problem := range reported {
+		if !expected[problem] {
+			t.Fatalf("bad: %v", reported)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package memberlist
+
+import (
+	"time"
+)
+
+// sizeChanged is called whenever a node joins or leaves. If OnSizeChange is
+// set, this arranges for checkSize to run once SizeChangeWindow has passed,
+// so a burst of changes gets looked at together.
+func (m *Memberlist) sizeChanged() {
+	if m.config.OnSizeChange == nil {
+		return
+	}
+
+	m.sizeLock.Lock()
+	defer m.sizeLock.Unlock()
+
+	if m.sizeTimer == nil {
+		m.sizeTimer = time.AfterFunc(m.config.SizeChangeWindow, m.checkSize)
+	}
+}
+
+// checkSize compares the number of live members with the size we last
+// reported, and calls OnSizeChange if it has changed significantly.
+func (m *Memberlist) checkSize() {
+	m.sizeLock.Lock()
+	m.sizeTimer = nil
+	old := m.lastSize
+	m.sizeLock.Unlock()
+
+	if m.hasShutdown() {
+		return
+	}
+
+	size := m.NumMembers()
+	if !m.significantSizeChange(old, size) {
+		return
+	}
+
+	m.sizeLock.Lock()
+	m.lastSize = size
+	m.sizeLock.Unlock()
+
+	m.config.OnSizeChange(old, size)
+}
+
+// significantSizeChange returns true if going from the old to the new size is
+// worth reporting, based on SizeChangePercent and SizeChangeThresholds.
+func (m *Memberlist) significantSizeChange(old, new int) bool {
+	if old == new {
+		return false
+	}
+
+	pct, thresholds := m.config.SizeChangePercent, m.config.SizeChangeThresholds
+	if pct <= 0 && len(thresholds) == 0 {
+		return true
+	}
+
+	if pct > 0 {
+		delta := new - old
+		if delta < 0 {
+			delta = -delta
+		}
+		if old == 0 || float64(delta)*100 >= pct*float64(old) {
+			return true
+		}
+	}
+
+	for _, t := range thresholds {
+		if (old < t) != (new < t) {
+			return true
+		}
+	}
+	return false
+}
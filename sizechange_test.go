@@ -0,0 +1,82 @@
+package memberlist
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMemberlist_OnSizeChange(t *testing.T) {
+	type change struct{ old, new int }
+	ch := make(chan change, 4)
+
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	m.config.SizeChangeWindow = 20 * time.Millisecond
+	m.config.OnSizeChange = func(old, new int) {
+		ch <- change{old, new}
+	}
+	m.setAlive()
+
+	// A burst of joins should be reported once.
+	for i := 0; i < 4; i++ {
+		a := alive{Node: fmt.Sprintf("test%d", i), Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+		m.aliveNode(&a, nil, false)
+	}
+	select {
+	case c := <-ch:
+		if c.old != 1 || c.new != 5 {
+			t.Fatalf("bad: %v", c)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for size change")
+	}
+
+	// Losing a single node isn't enough with a percentage set.
+	m.config.SizeChangePercent = 50
+	d := dead{Node: "test0", From: "test1", Incarnation: 1}
+	m.deadNode(&d)
+	time.Sleep(50 * time.Millisecond)
+	if len(ch) != 0 {
+		t.Fatalf("bad: %v", <-ch)
+	}
+
+	// But losing another two is, measured against what was last reported.
+	for _, name := range []string{"test1", "test2"} {
+		d := dead{Node: name, From: "test3", Incarnation: 1}
+		m.deadNode(&d)
+	}
+	select {
+	case c := <-ch:
+		if c.old != 5 || c.new != 2 {
+			t.Fatalf("bad: %v", c)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for size change")
+	}
+}
+
+func TestMemberlist_SignificantSizeChange(t *testing.T) {
+	cases := []struct {
+		pct        float64
+		thresholds []int
+		old, new   int
+		expected   bool
+	}{
+		{0, nil, 3, 3, false},
+		{0, nil, 3, 4, true},
+		{10, nil, 100, 105, false},
+		{10, nil, 100, 110, true},
+		{10, nil, 100, 90, true},
+		{0, []int{10}, 8, 9, false},
+		{0, []int{10}, 9, 10, true},
+		{0, []int{10}, 10, 9, true},
+		{50, []int{10}, 9, 10, true},
+	}
+	for i, c := range cases {
+		m := &Memberlist{config: &Config{SizeChangePercent: c.pct, SizeChangeThresholds: c.thresholds}}
+		if got := m.significantSizeChange(c.old, c.new); got != c.expected {
+			t.Errorf("case %d: got %v", i, got)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package memberlist
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// snapshot is invoked every SnapshotInterval period to save the addresses of
+// the live members to the SnapshotPath. If there's no one else alive, then we
+// keep the last snapshot, since an empty one can't help us find our way back
+// into the cluster.
+func (m *Memberlist) snapshot() {
+	m.nodeLock.RLock()
+	var hosts []string
+	for _, n := range m.nodes {
+		if n.Name == m.config.Name || n.State == stateDead {
+			continue
+		}
+		hosts = append(hosts, n.Address())
+	}
+	m.nodeLock.RUnlock()
+
+	if len(hosts) == 0 {
+		return
+	}
+	if err := writeSnapshot(m.config.SnapshotPath, hosts); err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to write snapshot: %v", err)
+	}
+}
+
+// writeSnapshot atomically replaces the snapshot at the given path with the
+// given hosts, one per line.
+func writeSnapshot(path string, hosts []string) error {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := ioutil.TempFile(dir, base+".tmp")
+	if err != nil {
+		return err
+	}
+
+	// Clean up the temporary file if we don't make it to the rename.
+	success := false
+	defer func() {
+		if !success {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	w := bufio.NewWriter(tmp)
+	for _, host := range hosts {
+		if _, err := fmt.Fprintln(w, host); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	success = true
+	return nil
+}
+
+// readSnapshot returns the hosts saved in the snapshot at the given path.
+func readSnapshot(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var hosts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if host := strings.TrimSpace(scanner.Text()); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
@@ -0,0 +1,154 @@
+package memberlist
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshot_WriteRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memberlist")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot")
+
+	if _, err := readSnapshot(path); err == nil {
+		t.Fatalf("should fail with no snapshot")
+	}
+
+	for _, hosts := range [][]string{
+		[]string{"127.0.0.1:7946", "127.0.0.2:7946"},
+		[]string{"127.0.0.3:7946"},
+	} {
+		if err := writeSnapshot(path, hosts); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		out, err := readSnapshot(path)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(out) != len(hosts) {
+			t.Fatalf("bad: %v", out)
+		}
+		for i := range hosts {
+			if out[i] != hosts[i] {
+				t.Fatalf("bad: %v", out)
+			}
+		}
+	}
+
+	// Make sure no temporary files were left behind.
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("bad: %v", files)
+	}
+}
+
+func TestMemberlist_JoinFromSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memberlist")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c1 := testConfig()
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.BindPort = m1.config.BindPort
+	c2.SnapshotPath = filepath.Join(dir, "snapshot")
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := m2.Join([]string{c1.BindAddr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	m2.snapshot()
+	m2.Shutdown()
+
+	// Start back up with the same snapshot and no seeds.
+	c3 := testConfig()
+	c3.BindPort = m1.config.BindPort
+	c3.SnapshotPath = c2.SnapshotPath
+	m3, err := Create(c3)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m3.Shutdown()
+
+	num, err := m3.Join(nil)
+	if num != 1 {
+		t.Fatalf("unexpected 1: %d", num)
+	}
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	m3.nodeLock.RLock()
+	_, ok := m3.nodeMap[c1.Name]
+	m3.nodeLock.RUnlock()
+	if !ok {
+		t.Fatalf("should know about the seed: %v", m3.Members())
+	}
+}
+
+func TestMemberlist_Snapshot_KeepsLastMembers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memberlist")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := testConfig()
+	c.SnapshotPath = filepath.Join(dir, "snapshot")
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m.Shutdown()
+
+	// With no snapshot on hand, joining from it fails.
+	if _, err := m.Join(nil); err == nil {
+		t.Fatalf("should fail with no snapshot")
+	}
+
+	// Being alone doesn't write an empty snapshot.
+	m.snapshot()
+	if _, err := os.Stat(c.SnapshotPath); !os.IsNotExist(err) {
+		t.Fatalf("should not write a snapshot: %v", err)
+	}
+
+	// Once there's someone to save, losing them keeps the snapshot.
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1}
+	m.aliveNode(&a, nil, false)
+	m.snapshot()
+	d := dead{Node: "test", Incarnation: 1}
+	m.deadNode(&d)
+	m.snapshot()
+
+	hosts, err := readSnapshot(c.SnapshotPath)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(hosts) != 1 || hosts[0] != "127.0.0.1:7946" {
+		t.Fatalf("bad: %v", hosts)
+	}
+
+	// An empty snapshot is an error rather than a join with no one.
+	if err := writeSnapshot(c.SnapshotPath, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if num, err := m.Join(nil); num != 0 || err == nil {
+		t.Fatalf("should fail with an empty snapshot: %d %v", num, err)
+	}
+}
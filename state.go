@@ -4,12 +4,11 @@ import (
 	"bytes"
 	"fmt"
 	"math"
-	"math/rand"
 	"net"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
-
-	"github.com/armon/go-metrics"
 )
 
 type nodeStateType int
@@ -20,9 +19,18 @@ const (
 	stateDead
 )
 
+// gossipBackpressureDepth is how many queued broadcasts it takes to add one
+// more node to the gossip fan-out, see Config.MaxGossipNodes.
+const gossipBackpressureDepth = 32
+
+// newNodeAckSlack is how much we scale the probe timeouts for nodes within
+// the Config.NewNodeGracePeriod.
+const newNodeAckSlack = 2
+
 // Node represents a node in the cluster.
 type Node struct {
 	Name string
+	ID   string // Optional stable identity, see Config.ID
 	Addr net.IP
 	Port uint16
 	Meta []byte // Metadata from the delegate for this node.
@@ -51,6 +59,8 @@ type nodeState struct {
 	Incarnation uint32        // Last known incarnation number
 	State       nodeStateType // Current state
 	StateChange time.Time     // Time last state change happened
+	WAN         bool          // Address is in one of the Config.WANCIDRs
+	UpdatedBy   string        // Node that originated the last accepted update
 }
 
 // Address returns the host:port form of a node's address, suitable for use
@@ -83,9 +93,10 @@ func (m *Memberlist) schedule() {
 	m.tickerLock.Lock()
 	defer m.tickerLock.Unlock()
 
-	// If we already have tickers, then don't do anything, since we're
-	// scheduled
-	if len(m.tickers) > 0 {
+	// If we already have a stop channel, then don't do anything, since
+	// we're scheduled. We don't go by the tickers here since the push/pull
+	// goroutine runs without one.
+	if m.stopTick != nil {
 		return
 	}
 
@@ -93,39 +104,82 @@ func (m *Memberlist) schedule() {
 	// when we should stop the tickers.
 	stopCh := make(chan struct{})
 
+	// The staggers below are drawn here rather than in the goroutines, so
+	// the order they come out of the random number generator doesn't
+	// depend on how the goroutines get scheduled.
+
 	// Create a new probeTicker
 	if m.config.ProbeInterval > 0 {
 		t := time.NewTicker(m.config.ProbeInterval)
-		go m.triggerFunc(m.config.ProbeInterval, t.C, stopCh, m.probe)
+		go m.triggerFunc(m.randomStagger(m.config.ProbeInterval), t.C, stopCh, m.probe)
+		m.tickers = append(m.tickers, t)
+	}
+
+	// Create a WAN probe ticker if needed
+	if m.wanProbing() {
+		t := time.NewTicker(m.config.WANProbeInterval)
+		go m.triggerFunc(m.randomStagger(m.config.WANProbeInterval), t.C, stopCh, m.probeWAN)
 		m.tickers = append(m.tickers, t)
 	}
 
 	// Create a push pull ticker if needed
 	if m.config.PushPullInterval > 0 {
-		go m.pushPullTrigger(stopCh)
+		go m.pushPullTrigger(m.randomStagger(m.config.PushPullInterval), stopCh)
 	}
 
 	// Create a gossip ticker if needed
 	if m.config.GossipInterval > 0 && m.config.GossipNodes > 0 {
 		t := time.NewTicker(m.config.GossipInterval)
-		go m.triggerFunc(m.config.GossipInterval, t.C, stopCh, m.gossip)
+		go m.triggerFunc(m.randomStagger(m.config.GossipInterval), t.C, stopCh, m.gossip)
+		m.tickers = append(m.tickers, t)
+	}
+
+	// Create a WAN gossip ticker if needed
+	if m.wanGossiping() && m.config.GossipNodes > 0 {
+		t := time.NewTicker(m.config.WANGossipInterval)
+		go m.triggerFunc(m.randomStagger(m.config.WANGossipInterval), t.C, stopCh, m.gossipWAN)
+		m.tickers = append(m.tickers, t)
+	}
+
+	// Create a snapshot ticker if needed
+	if m.config.SnapshotInterval > 0 && m.config.SnapshotPath != "" {
+		t := time.NewTicker(m.config.SnapshotInterval)
+		go m.triggerFunc(m.randomStagger(m.config.SnapshotInterval), t.C, stopCh, m.snapshot)
+		m.tickers = append(m.tickers, t)
+	}
+
+	// Create a self-check ticker if needed
+	if m.config.SelfCheckInterval > 0 {
+		t := time.NewTicker(m.config.SelfCheckInterval)
+		go m.triggerFunc(m.randomStagger(m.config.SelfCheckInterval), t.C, stopCh, m.selfCheck)
 		m.tickers = append(m.tickers, t)
 	}
 
-	// If we made any tickers, then record the stopTick channel for
-	// later.
-	if len(m.tickers) > 0 {
-		m.stopTick = stopCh
+	// Create an isolation ticker if needed
+	if m.config.IsolationTimeout > 0 &&
+		(m.config.OnIsolated != nil || m.config.ReseedOnIsolation) {
+		t := time.NewTicker(m.config.IsolationTimeout)
+		go m.triggerFunc(m.randomStagger(m.config.IsolationTimeout), t.C, stopCh, m.checkIsolation)
+		m.tickers = append(m.tickers, t)
 	}
+
+	// Record the stopTick channel for later, even if we didn't make any
+	// tickers, so that deschedule can stop the push/pull goroutine.
+	m.stopTick = stopCh
+}
+
+// randomStagger returns a random delay of up to the given interval, used to
+// keep our periodic tasks from synchronizing with other nodes'.
+func (m *Memberlist) randomStagger(interval time.Duration) time.Duration {
+	return time.Duration(uint64(m.rng.Int63()) % uint64(interval))
 }
 
 // triggerFunc is used to trigger a function call each time a
-// message is received until a stop tick arrives.
+// message is received until a stop tick arrives. The first call waits
+// for the given stagger to avoid syncronizing.
 func (m *Memberlist) triggerFunc(stagger time.Duration, C <-chan time.Time, stop <-chan struct{}, f func()) {
-	// Use a random stagger to avoid syncronizing
-	randStagger := time.Duration(uint64(rand.Int63()) % uint64(stagger))
 	select {
-	case <-time.After(randStagger):
+	case <-time.After(stagger):
 	case <-stop:
 		return
 	}
@@ -142,14 +196,13 @@ func (m *Memberlist) triggerFunc(stagger time.Duration, C <-chan time.Time, stop
 // pushPullTrigger is used to periodically trigger a push/pull until
 // a stop tick arrives. We don't use triggerFunc since the push/pull
 // timer is dynamically scaled based on cluster size to avoid network
-// saturation
-func (m *Memberlist) pushPullTrigger(stop <-chan struct{}) {
+// saturation. The first push/pull waits for the given stagger to avoid
+// syncronizing.
+func (m *Memberlist) pushPullTrigger(stagger time.Duration, stop <-chan struct{}) {
 	interval := m.config.PushPullInterval
 
-	// Use a random stagger to avoid syncronizing
-	randStagger := time.Duration(uint64(rand.Int63()) % uint64(interval))
 	select {
-	case <-time.After(randStagger):
+	case <-time.After(stagger):
 	case <-stop:
 		return
 	}
@@ -172,8 +225,8 @@ func (m *Memberlist) deschedule() {
 	m.tickerLock.Lock()
 	defer m.tickerLock.Unlock()
 
-	// If we have no tickers, then we aren't scheduled.
-	if len(m.tickers) == 0 {
+	// If we have no stop channel, then we aren't scheduled.
+	if m.stopTick == nil {
 		return
 	}
 
@@ -186,70 +239,181 @@ func (m *Memberlist) deschedule() {
 		t.Stop()
 	}
 	m.tickers = nil
+	m.stopTick = nil
 }
 
 // Tick is used to perform a single round of failure detection and gossip
 func (m *Memberlist) probe() {
-	// Track the number of indexes we've considered probing
-	numCheck := 0
-START:
-	m.nodeLock.RLock()
+	m.probeClass(false)
+}
 
-	// Make sure we don't wrap around infinitely
-	if numCheck >= len(m.nodes) {
-		m.nodeLock.RUnlock()
+// probeWAN is used to perform a single round of failure detection and gossip
+// against the WAN peers, when they have their own probe cadence.
+func (m *Memberlist) probeWAN() {
+	m.probeClass(true)
+}
+
+// probeClass probes the next nodes in the rotation for either the LAN or the
+// WAN peers. If WAN peers aren't probed separately then the LAN rotation
+// covers all nodes. Up to ProbeConcurrency nodes are probed in parallel.
+func (m *Memberlist) probeClass(wan bool) {
+	concurrency := m.config.ProbeConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	// Pick the targets, stopping early if we come back around to a node
+	// we've already picked, which happens in small clusters.
+	var targets []nodeState
+	picked := make(map[string]struct{})
+	for len(targets) < concurrency {
+		node, ok := m.nextProbeTarget(wan)
+		if !ok {
+			break
+		}
+		if _, ok := picked[node.Name]; ok {
+			break
+		}
+		picked[node.Name] = struct{}{}
+		targets = append(targets, node)
+	}
+
+	// Probe the specific nodes
+	if len(targets) == 1 {
+		m.probeNode(&targets[0])
 		return
 	}
+	var wg sync.WaitGroup
+	for i := range targets {
+		wg.Add(1)
+		go func(node *nodeState) {
+			defer wg.Done()
+			m.probeNode(node)
+		}(&targets[i])
+	}
+	wg.Wait()
+}
 
-	// Handle the wrap around case
-	if m.probeIndex >= len(m.nodes) {
-		m.nodeLock.RUnlock()
-		m.resetNodes()
-		m.probeIndex = 0
-		numCheck++
-		goto START
+// nextProbeTarget advances the LAN or WAN probe rotation to the next node
+// that should be probed and returns it. This returns false if there's no
+// node to probe.
+func (m *Memberlist) nextProbeTarget(wan bool) (nodeState, bool) {
+	index := &m.probeIndex
+	if wan {
+		index = &m.wanProbeIndex
 	}
+	split := m.wanProbing()
+
+	// Walk the rotation, considering each index at most once so we don't
+	// wrap around infinitely. The length is checked on every pass under
+	// the lock, since resetNodes may have shrunk the list in between.
+	for numCheck := 0; ; numCheck++ {
+		m.nodeLock.RLock()
+
+		// If we're the only node then there's nothing to probe, so bail
+		// out right away instead of churning through resetNodes on every
+		// tick.
+		if numCheck >= len(m.nodes) || len(m.nodes) <= 1 {
+			m.nodeLock.RUnlock()
+			return nodeState{}, false
+		}
 
-	// Determine if we should probe this node
-	skip := false
-	var node nodeState
+		// Handle the wrap around case. Only the main rotation resets the
+		// nodes, otherwise we'd reap and shuffle twice as often.
+		if *index >= len(m.nodes) {
+			m.nodeLock.RUnlock()
+			if !wan {
+				m.resetNodes()
+			}
+			*index = 0
+			continue
+		}
 
-	node = *m.nodes[m.probeIndex]
-	if node.Name == m.config.Name {
-		skip = true
-	} else if node.State == stateDead {
-		skip = true
+		// Determine if we should probe this node
+		node := *m.nodes[*index]
+		skip := ""
+		if node.Name == m.config.Name {
+			skip = "self"
+		} else if node.State == stateDead {
+			skip = "dead"
+		} else if split && node.WAN != wan {
+			skip = "other-class"
+		}
+		m.nodeLock.RUnlock()
+		*index++
+
+		if skip == "" {
+			return node, true
+		}
+		if m.config.OnProbeSkip != nil {
+			m.config.OnProbeSkip(&node.Node, skip)
+		}
 	}
+}
 
-	// Potentially skip
-	m.nodeLock.RUnlock()
-	m.probeIndex++
-	if skip {
-		numCheck++
-		goto START
+// isWAN returns true if the given address falls within any of the configured
+// WAN networks.
+func (m *Memberlist) isWAN(ip net.IP) bool {
+	for _, n := range m.config.WANCIDRs {
+		if n.Contains(ip) {
+			return true
+		}
 	}
+	return false
+}
+
+// wanProbing returns true if WAN peers are probed on their own cadence.
+func (m *Memberlist) wanProbing() bool {
+	return len(m.config.WANCIDRs) > 0 && m.config.WANProbeInterval > 0
+}
 
-	// Probe the specific node
-	m.probeNode(&node)
+// wanGossiping returns true if WAN peers are gossiped to on their own cadence.
+func (m *Memberlist) wanGossiping() bool {
+	return len(m.config.WANCIDRs) > 0 && m.config.WANGossipInterval > 0
 }
 
 // probeNode handles a single round of failure checking on a node.
 func (m *Memberlist) probeNode(node *nodeState) {
-	defer metrics.MeasureSince([]string{"memberlist", "probeNode"}, time.Now())
+	defer measureSince(m.metricSink(), []string{"memberlist", "probeNode"}, time.Now())
+
+	// Let any observer know which node we are about to probe.
+	if m.config.OnProbe != nil {
+		m.config.OnProbe(&node.Node)
+	}
+
+	// Keep a record of each step if asked to, see TraceProbes. Steps added
+	// to a nil trace are ignored.
+	var trace *ProbeTrace
+	if m.config.TraceProbes {
+		trace = &ProbeTrace{Node: node.Name, Start: time.Now()}
+		defer m.sendProbeTrace(trace)
+	}
 
 	// We use our health awareness to scale the overall probe interval, so we
 	// slow down if we detect problems. The ticker that calls us can handle
 	// us running over the base interval, and will skip missed ticks.
 	probeInterval := m.awareness.ScaleTimeout(m.config.ProbeInterval)
 	if probeInterval > m.config.ProbeInterval {
-		metrics.IncrCounter([]string{"memberlist", "degraded", "probe"}, 1)
+		m.metricSink().IncrCounter([]string{"memberlist", "degraded", "probe"}, 1)
+	}
+
+	// Give nodes that only just became alive some extra time to answer,
+	// since the network paths to them may still be warming up.
+	probeTimeout := m.config.ProbeTimeout
+	if node.State == stateAlive && time.Since(node.StateChange) < m.config.NewNodeGracePeriod {
+		probeInterval *= newNodeAckSlack
+		probeTimeout *= newNodeAckSlack
 	}
 
 	// Prepare a ping message and setup an ack handler.
 	ping := ping{SeqNo: m.nextSeqNo(), Node: node.Name}
 	ackCh := make(chan ackMessage, m.config.IndirectChecks+1)
 	nackCh := make(chan struct{}, m.config.IndirectChecks+1)
-	m.setProbeChannels(ping.SeqNo, ackCh, nackCh, probeInterval)
+	if err := m.setProbeChannels(ping.SeqNo, ackCh, nackCh, probeInterval); err != nil {
+		m.logger.Printf("[WARN] memberlist: Skipping probe of %s: %s", node.Name, err)
+		trace.step("skipped", err.Error())
+		return
+	}
 
 	// Mark the sent time here, which should be after any pre-processing but
 	// before system calls to do the actual send. This probably over-reports
@@ -264,10 +428,21 @@ func (m *Memberlist) probeNode(node *nodeState) {
 	deadline := sent.Add(probeInterval)
 	addr := node.Address()
 	if node.State == stateAlive {
-		if err := m.encodeAndSendMsg(addr, pingMsg, &ping); err != nil {
+		buf, err := encode(pingMsg, &ping)
+		if err != nil {
+			m.logger.Printf("[ERR] memberlist: Failed to encode ping message: %s", err)
+			return
+		}
+		if err := m.checkPingSize(buf.Len()); err != nil {
+			m.logger.Printf("[ERR] memberlist: Failed to send ping to %s: %s", addr, err)
+			return
+		}
+		if err := m.sendMsg(addr, buf.Bytes()); err != nil {
 			m.logger.Printf("[ERR] memberlist: Failed to send ping: %s", err)
+			trace.step("ping-failed", err.Error())
 			return
 		}
+		trace.step("ping-sent", addr)
 	} else {
 		var msgs [][]byte
 		if buf, err := encode(pingMsg, &ping); err != nil {
@@ -285,10 +460,16 @@ func (m *Memberlist) probeNode(node *nodeState) {
 		}
 
 		compound := makeCompoundMessage(msgs)
+		if err := m.checkPingSize(compound.Len()); err != nil {
+			m.logger.Printf("[ERR] memberlist: Failed to send compound ping and suspect message to %s: %s", addr, err)
+			return
+		}
 		if err := m.rawSendMsgPacket(addr, &node.Node, compound.Bytes()); err != nil {
 			m.logger.Printf("[ERR] memberlist: Failed to send compound ping and suspect message to %s: %s", addr, err)
+			trace.step("ping-failed", err.Error())
 			return
 		}
+		trace.step("ping-sent", addr+" (with suspect)")
 	}
 
 	// Arrange for our self-awareness to get updated. At this point we've
@@ -305,8 +486,12 @@ func (m *Memberlist) probeNode(node *nodeState) {
 	select {
 	case v := <-ackCh:
 		if v.Complete == true {
+			m.recordProbeResult(node.Name, true)
+			rtt := v.Timestamp.Sub(sent)
+			trace.step("ack", rtt.String())
+			m.metricSink().IncrCounter([]string{"memberlist", "probe", "ack"}, 1)
+			m.probeRTTs.Add(rtt)
 			if m.config.Ping != nil {
-				rtt := v.Timestamp.Sub(sent)
 				m.config.Ping.NotifyPingComplete(&node.Node, rtt, v.Payload)
 			}
 			return
@@ -315,9 +500,13 @@ func (m *Memberlist) probeNode(node *nodeState) {
 		// As an edge case, if we get a timeout, we need to re-enqueue it
 		// here to break out of the select below.
 		if v.Complete == false {
+			m.recordProbeResult(node.Name, false)
+			trace.step("timeout", probeInterval.String())
 			ackCh <- v
 		}
-	case <-time.After(m.config.ProbeTimeout):
+	case <-time.After(probeTimeout):
+		m.recordProbeResult(node.Name, false)
+		trace.step("timeout", probeTimeout.String())
 		// Note that we don't scale this timeout based on awareness and
 		// the health score. That's because we don't really expect waiting
 		// longer to help get UDP through. Since health does extend the
@@ -327,18 +516,19 @@ func (m *Memberlist) probeNode(node *nodeState) {
 		m.logger.Printf("[DEBUG] memberlist: Failed ping: %v (timeout reached)", node.Name)
 	}
 
-	// Get some random live nodes.
+	// Fall back to indirect pings through some random live nodes.
+	m.metricSink().IncrCounter([]string{"memberlist", "probe", "indirect"}, 1)
 	m.nodeLock.RLock()
-	kNodes := kRandomNodes(m.config.IndirectChecks, m.nodes, func(n *nodeState) bool {
-		return n.Name == m.config.Name ||
-			n.Name == node.Name ||
-			n.State != stateAlive
-	})
+	kNodes := m.indirectRelays(node)
 	m.nodeLock.RUnlock()
 
 	// Attempt an indirect ping.
 	expectedNacks := 0
 	ind := indirectPingReq{SeqNo: ping.SeqNo, Target: node.Addr, Port: node.Port, Node: node.Name}
+	var relayCh chan string
+	if m.config.CorroborateIndirectAcks {
+		relayCh = make(chan string, len(kNodes))
+	}
 	for _, peer := range kNodes {
 		// We only expect nack to be sent from peers who understand
 		// version 4 of the protocol.
@@ -346,9 +536,24 @@ func (m *Memberlist) probeNode(node *nodeState) {
 			expectedNacks++
 		}
 
+		// Give each relay its own sequence number if we need to know
+		// which of them an ack came back from.
+		if relayCh != nil {
+			ind.SeqNo = m.nextSeqNo()
+			if err := m.setRelayChannels(ind.SeqNo, peer.Name, relayCh, nackCh, time.Until(deadline)); err != nil {
+				m.logger.Printf("[WARN] memberlist: Failed to send indirect ping: %s", err)
+				if ind.Nack {
+					expectedNacks--
+				}
+				continue
+			}
+		}
+
 		if err := m.encodeAndSendMsg(peer.Address(), indirectPingMsg, &ind); err != nil {
 			m.logger.Printf("[ERR] memberlist: Failed to send indirect ping: %s", err)
+			continue
 		}
+		trace.step("indirect-sent", peer.Name)
 	}
 
 	// Also make an attempt to contact the node directly over TCP. This
@@ -379,13 +584,27 @@ func (m *Memberlist) probeNode(node *nodeState) {
 	// Wait for the acks or timeout. Note that we don't check the fallback
 	// channel here because we want to issue a warning below if that's the
 	// *only* way we hear back from the peer, so we have to let this time
-	// out first to allow the normal UDP-based acks to come in.
-	select {
-	case v := <-ackCh:
-		if v.Complete == true {
+	// out first to allow the normal UDP-based acks to come in. There's no
+	// need for a separate timeout, since the reaper set up by
+	// setProbeChannels always sends an incomplete ack on the ackCh once
+	// the probe interval is up, even if nothing comes back at all.
+	if relayCh != nil {
+		if m.waitForCorroboration(node.Name, ackCh, relayCh) {
+			trace.step("indirect-ack", "")
+			m.metricSink().IncrCounter([]string{"memberlist", "probe", "indirect", "ack"}, 1)
 			return
 		}
+	} else {
+		select {
+		case v := <-ackCh:
+			if v.Complete == true {
+				trace.step("indirect-ack", "")
+				m.metricSink().IncrCounter([]string{"memberlist", "probe", "indirect", "ack"}, 1)
+				return
+			}
+		}
 	}
+	trace.step("indirect-timeout", "")
 
 	// Finally, poll the fallback channel. The timeouts are set such that
 	// the channel will have something or be closed without having to wait
@@ -393,6 +612,8 @@ func (m *Memberlist) probeNode(node *nodeState) {
 	for didContact := range fallbackCh {
 		if didContact {
 			m.logger.Printf("[WARN] memberlist: Was able to connect to %s but other probes failed, network may be misconfigured", node.Name)
+			trace.step("tcp-ack", "")
+			m.metricSink().IncrCounter([]string{"memberlist", "probe", "tcp", "ack"}, 1)
 			return
 		}
 	}
@@ -415,19 +636,178 @@ func (m *Memberlist) probeNode(node *nodeState) {
 
 	// No acks received from target, suspect it as failed.
 	m.logger.Printf("[INFO] memberlist: Suspect %s has failed, no acks received", node.Name)
+	trace.step("suspect", fmt.Sprintf("incarnation %d", node.Incarnation))
+	m.metricSink().IncrCounter([]string{"memberlist", "probe", "failed"}, 1)
+	m.writeEvent(eventProbeFail, &node.Node, node.Incarnation)
 	s := suspect{Incarnation: node.Incarnation, Node: node.Name, From: m.config.Name}
 	m.suspectNode(&s)
 }
 
+// indirectRelays picks up to IndirectChecks random live nodes to relay an
+// indirect probe of the given node, preferring ones in a different zone if
+// NodeZone is set. This must be called while the nodeLock is held.
+func (m *Memberlist) indirectRelays(target *nodeState) []*nodeState {
+	eligible := func(n *nodeState) bool {
+		return n.Name != m.config.Name &&
+			n.Name != target.Name &&
+			n.State == stateAlive
+	}
+
+	// Take what we can from other zones first, then top up from the rest.
+	// This looks at every node rather than sampling, so that we don't miss
+	// the few cross-zone nodes there may be, or the only relay in a small
+	// cluster.
+	zoneOf := m.config.NodeZone
+	zone := ""
+	if zoneOf != nil {
+		zone = zoneOf(&target.Node)
+	}
+	var cross, rest []*nodeState
+	for _, n := range m.nodes {
+		if !eligible(n) {
+			continue
+		}
+		if zoneOf == nil {
+			rest = append(rest, n)
+		} else if other := zoneOf(&n.Node); other != "" && other != zone {
+			cross = append(cross, n)
+		} else {
+			rest = append(rest, n)
+		}
+	}
+	shuffleNodes(m.rng, cross)
+	shuffleNodes(m.rng, rest)
+	relays := append(cross, rest...)
+	if len(relays) > m.config.IndirectChecks {
+		relays = relays[:m.config.IndirectChecks]
+	}
+	return relays
+}
+
+// waitForCorroboration waits out the indirect part of a probe when
+// CorroborateIndirectAcks is set. A late direct ack, or an ack relayed by a
+// reliable peer, is enough to consider the target alive. An ack from a relay
+// that failed its own last direct probe only counts once a second relay
+// backs it up. This returns true if the target should be considered alive.
+func (m *Memberlist) waitForCorroboration(target string, ackCh chan ackMessage, relayCh chan string) bool {
+	acks := 0
+	for {
+		select {
+		case v := <-ackCh:
+			if !v.Complete && acks > 0 {
+				m.metricSink().IncrCounter([]string{"memberlist", "probe", "uncorroborated"}, 1)
+				m.logger.Printf("[WARN] memberlist: Ignoring uncorroborated indirect ack for %s", target)
+			}
+			return v.Complete
+		case relay := <-relayCh:
+			acks++
+			if acks >= 2 || m.relayReliable(relay) {
+				return true
+			}
+		}
+	}
+}
+
+// setRelayChannels is used to attach the relayCh and nackCh to an indirect
+// ping sent through the given relay. Acks are reported as the name of the
+// relay they came back through.
+func (m *Memberlist) setRelayChannels(seqNo uint32, relay string, relayCh chan string, nackCh chan struct{}, timeout time.Duration) error {
+	// Create handler functions for acks and nacks
+	ackFn := func(payload []byte, timestamp time.Time) {
+		select {
+		case relayCh <- relay:
+		default:
+		}
+	}
+	nackFn := func() {
+		select {
+		case nackCh <- struct{}{}:
+		default:
+		}
+	}
+
+	// Add the handlers
+	ah := &ackHandler{ackFn, nackFn, nil}
+	if err := m.addAckHandler(seqNo, ah); err != nil {
+		return err
+	}
+
+	// Setup a reaping routing
+	ah.timer = time.AfterFunc(timeout, func() {
+		m.ackLock.Lock()
+		delete(m.ackHandlers, seqNo)
+		m.ackLock.Unlock()
+	})
+	return nil
+}
+
+// recordProbeResult keeps track of whether the given node answered our last
+// direct probe, for use by relayReliable. This is only tracked when
+// CorroborateIndirectAcks is set.
+func (m *Memberlist) recordProbeResult(name string, ok bool) {
+	if !m.config.CorroborateIndirectAcks {
+		return
+	}
+
+	m.probeMissLock.Lock()
+	defer m.probeMissLock.Unlock()
+
+	if ok {
+		delete(m.probeMisses, name)
+	} else {
+		m.probeMisses[name]++
+	}
+}
+
+// relayReliable returns true if the given node answered its last direct probe
+// from us, so an indirect ack relayed by it can be trusted on its own.
+func (m *Memberlist) relayReliable(name string) bool {
+	m.probeMissLock.Lock()
+	defer m.probeMissLock.Unlock()
+
+	return m.probeMisses[name] == 0
+}
+
+// checkPingSize makes sure an encoded ping fits in a single packet. Anything
+// larger risks being fragmented and silently dropped by the network, which
+// would look just like a failed probe, so we refuse to send it instead.
+func (m *Memberlist) checkPingSize(size int) error {
+	limit := m.config.UDPBufferSize - m.packetOverhead()
+	if size > limit {
+		m.metricSink().IncrCounter([]string{"memberlist", "ping", "oversized"}, 1)
+		return fmt.Errorf("ping of %d bytes exceeds the %d byte packet limit", size, limit)
+	}
+	return nil
+}
+
 // Ping initiates a ping to the node with the specified name.
 func (m *Memberlist) Ping(node string, addr net.Addr) (time.Duration, error) {
+	return m.directPing(node, addr.String(), m.config.ProbeTimeout)
+}
+
+// PingNode sends a single ping to the given node and returns the round trip
+// time, or an error if there's no answer within the timeout. This is only a
+// measurement, so a failed ping doesn't make the node suspect.
+func (m *Memberlist) PingNode(node *Node, timeout time.Duration) (time.Duration, error) {
+	return m.directPing(node.Name, node.Address(), timeout)
+}
+
+// directPing pings the node with the given name at the given address, waiting
+// up to the timeout for the ack.
+func (m *Memberlist) directPing(node string, addr string, timeout time.Duration) (time.Duration, error) {
 	// Prepare a ping message and setup an ack handler.
 	ping := ping{SeqNo: m.nextSeqNo(), Node: node}
 	ackCh := make(chan ackMessage, m.config.IndirectChecks+1)
-	m.setProbeChannels(ping.SeqNo, ackCh, nil, m.config.ProbeInterval)
+	reap := m.config.ProbeInterval
+	if timeout > reap {
+		reap = timeout
+	}
+	if err := m.setProbeChannels(ping.SeqNo, ackCh, nil, reap); err != nil {
+		return 0, err
+	}
 
 	// Send a ping to the node.
-	if err := m.encodeAndSendMsg(addr.String(), pingMsg, &ping); err != nil {
+	if err := m.encodeAndSendMsg(addr, pingMsg, &ping); err != nil {
 		return 0, err
 	}
 
@@ -442,7 +822,7 @@ func (m *Memberlist) Ping(node string, addr net.Addr) (time.Duration, error) {
 		if v.Complete == true {
 			return v.Timestamp.Sub(sent), nil
 		}
-	case <-time.After(m.config.ProbeTimeout):
+	case <-time.After(timeout):
 		// Timeout, return an error below.
 	}
 
@@ -459,9 +839,24 @@ func (m *Memberlist) resetNodes() {
 	// Move dead nodes, but respect gossip to the dead interval
 	deadIdx := moveDeadNodes(m.nodes, m.config.GossipToTheDeadTime)
 
+	// Keep some of the dead nodes around for later if we are limited in
+	// how many we can reap, putting the ones to keep first.
+	if limit := m.config.ReapLimit; limit > 0 && len(m.nodes)-deadIdx > limit {
+		dead := m.nodes[deadIdx:]
+		if less := m.config.ReapComparator; less != nil {
+			sort.SliceStable(dead, func(i, j int) bool {
+				return less(&dead[j].Node, &dead[i].Node)
+			})
+		}
+		deadIdx += len(dead) - limit
+	}
+
 	// Deregister the dead nodes
+	if reaped := len(m.nodes) - deadIdx; reaped > 0 {
+		m.metricSink().IncrCounter([]string{"memberlist", "nodes", "reaped"}, float32(reaped))
+	}
 	for i := deadIdx; i < len(m.nodes); i++ {
-		delete(m.nodeMap, m.nodes[i].Name)
+		m.deregisterNode(m.nodes[i])
 		m.nodes[i] = nil
 	}
 
@@ -472,20 +867,43 @@ func (m *Memberlist) resetNodes() {
 	atomic.StoreUint32(&m.numNodes, uint32(deadIdx))
 
 	// Shuffle live nodes
-	shuffleNodes(m.nodes)
+	shuffleNodes(m.rng, m.nodes)
 }
 
 // gossip is invoked every GossipInterval period to broadcast our gossip
 // messages to a few random nodes.
 func (m *Memberlist) gossip() {
-	defer metrics.MeasureSince([]string{"memberlist", "gossip"}, time.Now())
+	m.gossipClass(false)
+}
+
+// gossipWAN is invoked every WANGossipInterval period to broadcast our gossip
+// messages to a few random WAN peers, when they have their own gossip
+// cadence.
+func (m *Memberlist) gossipWAN() {
+	m.gossipClass(true)
+}
+
+// gossipClass sends a gossip round to either the LAN or the WAN peers. If WAN
+// peers aren't gossiped to separately then the LAN round covers all nodes.
+func (m *Memberlist) gossipClass(wan bool) {
+	defer measureSince(m.metricSink(), []string{"memberlist", "gossip"}, time.Now())
+	split := m.wanGossiping()
+	failed := m.gossipFailures()
 
-	// Get some random live, suspect, or recently dead nodes
+	// Get some random live, suspect, or recently dead nodes, skipping any
+	// we recently failed to send to. Those will still get probed, which is
+	// how we'll find out if they are really gone.
 	m.nodeLock.RLock()
-	kNodes := kRandomNodes(m.config.GossipNodes, m.nodes, func(n *nodeState) bool {
+	kNodes := kRandomNodes(m.rng, m.gossipFanout(), m.nodes, func(n *nodeState) bool {
 		if n.Name == m.config.Name {
 			return true
 		}
+		if split && n.WAN != wan {
+			return true
+		}
+		if _, ok := failed[n.Name]; ok {
+			return true
+		}
 
 		switch n.State {
 		case stateAlive, stateSuspect:
@@ -507,26 +925,172 @@ func (m *Memberlist) gossip() {
 	}
 
 	for _, node := range kNodes {
-		// Get any pending broadcasts
+		// Get any pending broadcasts, and fill any space that's left with
+		// the state of some of the nodes that are down.
 		msgs := m.getBroadcasts(compoundOverhead, bytesAvail)
+		used := 0
+		for _, msg := range msgs {
+			used += compoundOverhead + len(msg)
+		}
+		msgs = append(msgs, m.downNodeStates(compoundOverhead, bytesAvail-used)...)
 		if len(msgs) == 0 {
 			return
 		}
 
+		// Send single message as is, otherwise create and send a
+		// compound message
+		msg := msgs[0]
+		if len(msgs) > 1 {
+			msg = makeCompoundMessage(msgs).Bytes()
+		}
+
 		addr := node.Address()
-		if len(msgs) == 1 {
-			// Send single message as is
-			if err := m.rawSendMsgPacket(addr, &node.Node, msgs[0]); err != nil {
-				m.logger.Printf("[ERR] memberlist: Failed to send gossip to %s: %s", addr, err)
-			}
+		err := m.rawSendMsgPacket(addr, &node.Node, msg)
+		if err != nil {
+			m.logger.Printf("[ERR] memberlist: Failed to send gossip to %s: %s", addr, err)
 		} else {
-			// Otherwise create and send a compound message
-			compound := makeCompoundMessage(msgs)
-			if err := m.rawSendMsgPacket(addr, &node.Node, compound.Bytes()); err != nil {
-				m.logger.Printf("[ERR] memberlist: Failed to send gossip to %s: %s", addr, err)
+			m.metricSink().IncrCounter([]string{"memberlist", "gossip", "sent"}, float32(len(msg)))
+		}
+		m.recordGossipSend(node.Name, err)
+	}
+}
+
+// downNodeStates returns encoded suspect and dead messages for up to
+// GossipDownNodes random nodes that are suspect or recently dead, to be
+// piggybacked on gossip. The messages are attributed to whoever we heard
+// the state from, so a leave still reads as a leave. Only as many as fit
+// in the limit are returned.
+func (m *Memberlist) downNodeStates(overhead, limit int) [][]byte {
+	if m.config.GossipDownNodes <= 0 {
+		return nil
+	}
+
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	// Look at every node rather than sampling, since there are usually only
+	// a few down nodes and we don't want to miss any of them.
+	var down []*nodeState
+	for _, n := range m.nodes {
+		if n.Name == m.config.Name {
+			continue
+		}
+
+		switch n.State {
+		case stateSuspect:
+			down = append(down, n)
+
+		case stateDead:
+			if time.Since(n.StateChange) <= m.config.GossipToTheDeadTime {
+				down = append(down, n)
 			}
 		}
 	}
+	shuffleNodes(m.rng, down)
+	if len(down) > m.config.GossipDownNodes {
+		down = down[:m.config.GossipDownNodes]
+	}
+
+	var msgs [][]byte
+	bytesUsed := 0
+	for _, n := range down {
+		from := n.UpdatedBy
+		if from == "" {
+			from = m.config.Name
+		}
+
+		var buf *bytes.Buffer
+		var err error
+		if n.State == stateSuspect {
+			buf, err = encode(suspectMsg, &suspect{Incarnation: n.Incarnation, Node: n.Name, From: from})
+		} else {
+			buf, err = encode(deadMsg, &dead{Incarnation: n.Incarnation, Node: n.Name, From: from})
+		}
+		if err != nil {
+			m.logger.Printf("[ERR] memberlist: Failed to encode state of %s for gossip: %s", n.Name, err)
+			continue
+		}
+
+		if bytesUsed+overhead+buf.Len() > limit {
+			continue
+		}
+		bytesUsed += overhead + buf.Len()
+		msgs = append(msgs, buf.Bytes())
+	}
+	return msgs
+}
+
+// gossipFanout returns the number of nodes to gossip to this round. This is
+// normally GossipNodes, or scaled to the cluster size if GossipMult is set,
+// and grows with the depth of the broadcast queue if MaxGossipNodes allows
+// it, so that we can drain a backlog faster.
+func (m *Memberlist) gossipFanout() int {
+	fanout := m.config.GossipNodes
+	if m.config.GossipMult > 0 {
+		// This scales the same way as the retransmit limit.
+		if scaled := retransmitLimit(m.config.GossipMult, m.estNumNodes()); scaled > fanout {
+			fanout = scaled
+		}
+	}
+	if m.config.MaxGossipNodes > m.config.GossipNodes {
+		fanout += m.broadcasts.NumQueued() / gossipBackpressureDepth
+		if fanout > m.config.MaxGossipNodes {
+			fanout = m.config.MaxGossipNodes
+		}
+	}
+
+	atomic.StoreInt32(&m.lastGossipFanout, int32(fanout))
+	m.metricSink().SetGauge([]string{"memberlist", "gossip", "fanout"}, float32(fanout))
+	return fanout
+}
+
+// gossipFailures returns the set of nodes we've failed to send gossip to
+// within the last ProbeInterval, which should be skipped when picking gossip
+// targets. Older failures are forgotten.
+func (m *Memberlist) gossipFailures() map[string]struct{} {
+	m.gossipFailLock.Lock()
+	defer m.gossipFailLock.Unlock()
+
+	failed := make(map[string]struct{})
+	for name, when := range m.gossipFailTimes {
+		if time.Since(when) > m.config.ProbeInterval {
+			delete(m.gossipFailTimes, name)
+			continue
+		}
+		failed[name] = struct{}{}
+	}
+	return failed
+}
+
+// recordGossipSend keeps track of the outcome of sending gossip to the given
+// node, for use by gossipFailures.
+func (m *Memberlist) recordGossipSend(name string, err error) {
+	m.gossipFailLock.Lock()
+	defer m.gossipFailLock.Unlock()
+
+	if err != nil {
+		m.gossipFailTimes[name] = time.Now()
+	} else {
+		delete(m.gossipFailTimes, name)
+	}
+}
+
+// nextPushPullNode picks the next push/pull partner in rotation for
+// RoundRobinPushPull, skipping any nodes the filterFn returns true for, just
+// like the probe rotation does. This returns nothing if there are no nodes
+// left to pick from. This must be called while the nodeLock is held.
+func (m *Memberlist) nextPushPullNode(filterFn func(*nodeState) bool) []*nodeState {
+	for i := 0; i < len(m.nodes); i++ {
+		if m.pushPullIndex >= len(m.nodes) {
+			m.pushPullIndex = 0
+		}
+		n := m.nodes[m.pushPullIndex]
+		m.pushPullIndex++
+		if !filterFn(n) {
+			return []*nodeState{n}
+		}
+	}
+	return nil
 }
 
 // pushPull is invoked periodically to randomly perform a complete state
@@ -536,10 +1100,18 @@ func (m *Memberlist) gossip() {
 func (m *Memberlist) pushPull() {
 	// Get a random live node
 	m.nodeLock.RLock()
-	nodes := kRandomNodes(1, m.nodes, func(n *nodeState) bool {
+	exclude := m.config.PushPullExcludeFunc
+	filterFn := func(n *nodeState) bool {
 		return n.Name == m.config.Name ||
-			n.State != stateAlive
-	})
+			n.State != stateAlive ||
+			(exclude != nil && exclude(&n.Node))
+	}
+	var nodes []*nodeState
+	if m.config.RoundRobinPushPull {
+		nodes = m.nextPushPullNode(filterFn)
+	} else {
+		nodes = kRandomNodes(m.rng, 1, m.nodes, filterFn)
+	}
 	m.nodeLock.RUnlock()
 
 	// If no nodes, bail
@@ -554,9 +1126,115 @@ func (m *Memberlist) pushPull() {
 	}
 }
 
+// checkIsolation is invoked every IsolationTimeout period to see if we've
+// been without any live peers for at least that long, and if so lets the
+// application know about it and attempts to reseed if configured.
+func (m *Memberlist) checkIsolation() {
+	if !m.IsAlone() {
+		m.aloneSince = time.Time{}
+		m.reseedBackoff = 0
+		m.nextReseed = time.Time{}
+		return
+	}
+
+	now := time.Now()
+	if m.aloneSince.IsZero() {
+		m.aloneSince = now
+	}
+	if now.Sub(m.aloneSince) < m.config.IsolationTimeout {
+		return
+	}
+
+	if m.config.OnIsolated != nil {
+		m.config.OnIsolated()
+	}
+	if m.config.ReseedOnIsolation {
+		m.reseed(now)
+	}
+}
+
+// reseed attempts to rejoin the cluster after we've become isolated, backing
+// off exponentially between failed attempts.
+func (m *Memberlist) reseed(now time.Time) {
+	if now.Before(m.nextReseed) {
+		return
+	}
+
+	seeds := m.config.ReseedNodes
+	if len(seeds) == 0 {
+		m.joinLock.Lock()
+		seeds = m.joinNodes
+		m.joinLock.Unlock()
+	}
+	if len(seeds) == 0 && m.config.SnapshotPath == "" {
+		m.backoffReseed(now)
+		m.logger.Printf("[WARN] memberlist: Isolated but no nodes to reseed from, checking again in %s", m.reseedBackoff)
+		return
+	}
+
+	// Joining no one doesn't get us out of isolation, so that counts as a
+	// failure too.
+	num, err := m.Join(seeds)
+	if err == nil && num == 0 {
+		err = fmt.Errorf("no nodes were joined")
+	}
+	if err != nil {
+		m.backoffReseed(now)
+		m.logger.Printf("[WARN] memberlist: Failed to reseed, retrying in %s: %v", m.reseedBackoff, err)
+		return
+	}
+
+	m.logger.Printf("[INFO] memberlist: Reseeded after being isolated")
+	m.reseedBackoff = 0
+	m.nextReseed = time.Time{}
+}
+
+// backoffReseed pushes back the next reseed attempt, starting from
+// IsolationTimeout and doubling each time up to ReseedMaxBackoff.
+func (m *Memberlist) backoffReseed(now time.Time) {
+	if m.reseedBackoff == 0 {
+		m.reseedBackoff = m.config.IsolationTimeout
+	} else {
+		m.reseedBackoff *= 2
+	}
+	if max := m.config.ReseedMaxBackoff; max > 0 && m.reseedBackoff > max {
+		m.reseedBackoff = max
+	}
+	m.nextReseed = now.Add(m.reseedBackoff)
+}
+
+// nameConflict returns true if the given remote state has another alive node
+// using our name. A node with our ID is assumed to be an older version of us.
+func (m *Memberlist) nameConflict(remote []pushNodeState) bool {
+	m.nodeLock.RLock()
+	local, ok := m.nodeMap[m.config.Name]
+	var addr net.IP
+	var port uint16
+	if ok {
+		addr, port = local.Addr, local.Port
+	}
+	m.nodeLock.RUnlock()
+	if !ok {
+		return false
+	}
+
+	for _, r := range remote {
+		if r.Name != m.config.Name || r.State != stateAlive {
+			continue
+		}
+		if m.config.ID != "" && r.ID == m.config.ID {
+			continue
+		}
+		if !addr.Equal(net.IP(r.Addr)) || port != r.Port {
+			return true
+		}
+	}
+	return false
+}
+
 // pushPullNode does a complete state exchange with a specific node.
 func (m *Memberlist) pushPullNode(addr string, join bool) error {
-	defer metrics.MeasureSince([]string{"memberlist", "pushPullNode"}, time.Now())
+	defer measureSince(m.metricSink(), []string{"memberlist", "pushPullNode"}, time.Now())
 
 	// Attempt to send and receive with the node
 	remote, userState, err := m.sendAndReceiveState(addr, join)
@@ -564,6 +1242,12 @@ func (m *Memberlist) pushPullNode(addr string, join bool) error {
 		return err
 	}
 
+	// Make sure nobody else is using our name before we join, unless
+	// there's a delegate to handle conflicts.
+	if join && m.config.Conflict == nil && m.nameConflict(remote) {
+		return ErrNameConflict
+	}
+
 	if err := m.mergeRemoteState(join, remote, userState); err != nil {
 		return err
 	}
@@ -718,8 +1402,9 @@ type ackMessage struct {
 // setProbeChannels is used to attach the ackCh to receive a message when an ack
 // with a given sequence number is received. The `complete` field of the message
 // will be false on timeout. Any nack messages will cause an empty struct to be
-// passed to the nackCh, which can be nil if not needed.
-func (m *Memberlist) setProbeChannels(seqNo uint32, ackCh chan ackMessage, nackCh chan struct{}, timeout time.Duration) {
+// passed to the nackCh, which can be nil if not needed. This returns an error
+// if there are already too many pending acks, see MaxPendingAcks.
+func (m *Memberlist) setProbeChannels(seqNo uint32, ackCh chan ackMessage, nackCh chan struct{}, timeout time.Duration) error {
 	// Create handler functions for acks and nacks
 	ackFn := func(payload []byte, timestamp time.Time) {
 		select {
@@ -736,9 +1421,9 @@ func (m *Memberlist) setProbeChannels(seqNo uint32, ackCh chan ackMessage, nackC
 
 	// Add the handlers
 	ah := &ackHandler{ackFn, nackFn, nil}
-	m.ackLock.Lock()
-	m.ackHandlers[seqNo] = ah
-	m.ackLock.Unlock()
+	if err := m.addAckHandler(seqNo, ah); err != nil {
+		return err
+	}
 
 	// Setup a reaping routing
 	ah.timer = time.AfterFunc(timeout, func() {
@@ -750,18 +1435,20 @@ func (m *Memberlist) setProbeChannels(seqNo uint32, ackCh chan ackMessage, nackC
 		default:
 		}
 	})
+	return nil
 }
 
 // setAckHandler is used to attach a handler to be invoked when an ack with a
 // given sequence number is received. If a timeout is reached, the handler is
 // deleted. This is used for indirect pings so does not configure a function
-// for nacks.
-func (m *Memberlist) setAckHandler(seqNo uint32, ackFn func([]byte, time.Time), timeout time.Duration) {
+// for nacks. This returns an error if there are already too many pending
+// acks, see MaxPendingAcks.
+func (m *Memberlist) setAckHandler(seqNo uint32, ackFn func([]byte, time.Time), timeout time.Duration) error {
 	// Add the handler
 	ah := &ackHandler{ackFn, nil, nil}
-	m.ackLock.Lock()
-	m.ackHandlers[seqNo] = ah
-	m.ackLock.Unlock()
+	if err := m.addAckHandler(seqNo, ah); err != nil {
+		return err
+	}
 
 	// Setup a reaping routing
 	ah.timer = time.AfterFunc(timeout, func() {
@@ -769,6 +1456,22 @@ func (m *Memberlist) setAckHandler(seqNo uint32, ackFn func([]byte, time.Time),
 		delete(m.ackHandlers, seqNo)
 		m.ackLock.Unlock()
 	})
+	return nil
+}
+
+// addAckHandler registers an ack handler for the given sequence number, unless
+// MaxPendingAcks handlers are already waiting, in which case it's refused
+// until some of those drain.
+func (m *Memberlist) addAckHandler(seqNo uint32, ah *ackHandler) error {
+	m.ackLock.Lock()
+	defer m.ackLock.Unlock()
+
+	if max := m.config.MaxPendingAcks; max > 0 && len(m.ackHandlers) >= max {
+		m.metricSink().IncrCounter([]string{"memberlist", "acks", "rejected"}, 1)
+		return fmt.Errorf("too many pending acks (%d)", len(m.ackHandlers))
+	}
+	m.ackHandlers[seqNo] = ah
+	return nil
 }
 
 // Invokes an ack handler if any is associated, and reaps the handler immediately
@@ -801,12 +1504,17 @@ func (m *Memberlist) invokeNackHandler(nack nackResp) {
 // This alters the node state that's passed in so this MUST be called while the
 // nodeLock is held.
 func (m *Memberlist) refute(me *nodeState, accusedInc uint32) {
-	// Make sure the incarnation number beats the accusation.
+	// Make sure the incarnation number beats the accusation, as well as
+	// any other incarnation we've seen for ourselves.
+	if m.compareIncarnation(m.selfIncarnationSeen, accusedInc) > 0 {
+		accusedInc = m.selfIncarnationSeen
+	}
 	inc := m.nextIncarnation()
-	if accusedInc >= inc {
+	if m.compareIncarnation(accusedInc, inc) >= 0 {
 		inc = m.skipIncarnation(accusedInc - inc + 1)
 	}
 	me.Incarnation = inc
+	m.writeEvent(eventRefute, &me.Node, inc)
 
 	// Decrease our health because we are being asked to refute a problem.
 	m.awareness.ApplyDelta(1)
@@ -815,6 +1523,7 @@ func (m *Memberlist) refute(me *nodeState, accusedInc uint32) {
 	a := alive{
 		Incarnation: inc,
 		Node:        me.Name,
+		ID:          me.ID,
 		Addr:        me.Addr,
 		Port:        me.Port,
 		Meta:        me.Meta,
@@ -865,28 +1574,56 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 		}
 	}
 
+	// Keep track of the highest incarnation we've seen for ourselves, even
+	// if we end up ignoring the message below, since it may still be in
+	// flight around the cluster and any refute we send needs to beat it.
+	// This only counts messages the Alive delegate lets through.
+	if a.Node == m.config.Name && m.compareIncarnation(a.Incarnation, m.selfIncarnationSeen) > 0 {
+		m.selfIncarnationSeen = a.Incarnation
+	}
+
+	// If we know this node by its ID under a different name, then it may
+	// have been renamed, so carry over the existing state. The rename itself
+	// waits until we know the message is newer than what we have.
+	renamed := false
+	if !ok && a.ID != "" {
+		if old, found := m.nodeIDs[a.ID]; found && old.Name != m.config.Name {
+			state, ok, renamed = old, true, true
+		}
+	}
+
+	// Hold off on adding nodes we haven't confirmed ourselves, if needed.
+	if !ok && !bootstrap && m.config.ConfirmBeforeAdd && !m.confirmPending(a) {
+		return
+	}
+
 	// Check if we've never seen this node before, and if not, then
 	// store this node in our node map.
 	if !ok {
 		state = &nodeState{
 			Node: Node{
 				Name: a.Node,
+				ID:   a.ID,
 				Addr: a.Addr,
 				Port: a.Port,
 				Meta: a.Meta,
 			},
 			State: stateDead,
+			WAN:   m.isWAN(a.Addr),
 		}
 
 		// Add to map
 		m.nodeMap[a.Node] = state
+		if a.ID != "" {
+			m.nodeIDs[a.ID] = state
+		}
 
 		// Get a random offset. This is important to ensure
 		// the failure detection bound is low on average. If all
 		// nodes did an append, failure detection bound would be
 		// very high.
 		n := len(m.nodes)
-		offset := randomOffset(n)
+		offset := randomOffset(m.rng, n)
 
 		// Add at the end and swap with the node at the offset
 		m.nodes = append(m.nodes, state)
@@ -896,8 +1633,10 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 		atomic.AddUint32(&m.numNodes, 1)
 	}
 
-	// Check if this address is different than the existing node
-	if !bytes.Equal([]byte(state.Addr), a.Addr) || state.Port != a.Port {
+	// Check if this address is different than the existing node. A renamed
+	// node is matched by its ID rather than its address, so it's free to
+	// come back somewhere else.
+	if !renamed && (!bytes.Equal([]byte(state.Addr), a.Addr) || state.Port != a.Port) {
 		m.logger.Printf("[ERR] memberlist: Conflicting address for %s. Mine: %v:%d Theirs: %v:%d",
 			state.Name, state.Addr, state.Port, net.IP(a.Addr), a.Port)
 
@@ -914,17 +1653,31 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 		return
 	}
 
-	// Bail if the incarnation number is older, and this is not about us
+	// Bail if the incarnation number is older, and this is not about us.
+	// If it's the same incarnation with different meta data then we need
+	// to pick a winner, otherwise nodes could end up disagreeing forever.
 	isLocalNode := state.Name == m.config.Name
-	if a.Incarnation <= state.Incarnation && !isLocalNode {
-		return
+	cmp := m.compareIncarnation(a.Incarnation, state.Incarnation)
+	if cmp <= 0 && !isLocalNode {
+		if cmp < 0 || !m.metaTieBreak(state, a) {
+			return
+		}
 	}
 
 	// Bail if strictly less and this is about us
-	if a.Incarnation < state.Incarnation && isLocalNode {
+	if cmp < 0 && isLocalNode {
 		return
 	}
 
+	// Only rename for a strictly newer incarnation, otherwise a stale
+	// message under the old name would rename the node back.
+	if renamed {
+		if cmp <= 0 {
+			return
+		}
+		m.renameNode(state, a)
+	}
+
 	// Clear out any suspicion timer that may be in effect.
 	delete(m.nodeTimers, a.Node)
 
@@ -951,7 +1704,7 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 		// need to do an equality check for this Incarnation. In most cases,
 		// we just ignore, but we may need to refute.
 		//
-		if a.Incarnation == state.Incarnation &&
+		if cmp == 0 &&
 			bytes.Equal(a.Meta, state.Meta) &&
 			bytes.Equal(a.Vsn, versions) {
 			return
@@ -960,7 +1713,14 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 		m.refute(state, a.Incarnation)
 		m.logger.Printf("[WARN] memberlist: Refuting an alive message")
 	} else {
-		m.encodeBroadcastNotify(a.Node, aliveMsg, a, notify)
+		// Keep a node that's churning through meta data changes from
+		// flooding the cluster. We still take the update, but leave it
+		// to the messages already in flight to spread it.
+		if ok && !isLocalNode && !bytes.Equal(state.Meta, a.Meta) && !m.allowMetaUpdate(a.Node) {
+			m.metricSink().IncrCounter([]string{"memberlist", "msg", "alive", "throttled"}, 1)
+		} else {
+			m.rebroadcast(a.Node, a.Node, aliveMsg, a, notify)
+		}
 
 		// Update protocol versions if it arrived
 		if len(a.Vsn) > 0 {
@@ -972,9 +1732,18 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 			state.DCur = a.Vsn[5]
 		}
 
-		// Update the state and incarnation number
+		// Update the state and incarnation number. Alive messages can
+		// only be originated by the node itself.
 		state.Incarnation = a.Incarnation
 		state.Meta = a.Meta
+		state.UpdatedBy = a.Node
+		if state.ID == "" && a.ID != "" {
+			state.ID = a.ID
+			m.nodeIDs[a.ID] = state
+		}
+		if state.State == stateDead {
+			delete(m.deadAddrs, state.Address())
+		}
 		if state.State != stateAlive {
 			state.State = stateAlive
 			state.StateChange = time.Now()
@@ -982,11 +1751,20 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 	}
 
 	// Update metrics
-	metrics.IncrCounter([]string{"memberlist", "msg", "alive"}, 1)
+	m.metricSink().IncrCounter([]string{"memberlist", "msg", "alive"}, 1)
+
+	if oldState == stateDead {
+		m.writeEvent(eventJoin, &state.Node, state.Incarnation)
+	}
+
+	// If the node came back before we announced that it left, then there's
+	// no need to announce it joining either. Renamed nodes always join,
+	// since renameNode announced the old name leaving.
+	joined := renamed || oldState == stateDead && !m.cancelLeave(state.Name)
 
 	// Notify the delegate of any relevant updates
 	if m.config.Events != nil {
-		if oldState == stateDead {
+		if joined {
 			// if Dead -> Alive, notify of join
 			m.config.Events.NotifyJoin(&state.Node)
 
@@ -995,6 +1773,160 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 			m.config.Events.NotifyUpdate(&state.Node)
 		}
 	}
+
+	// Let any subscribers know as well
+	if joined {
+		m.publish(NodeJoin, &state.Node)
+		m.sizeChanged()
+	} else if !bytes.Equal(oldMeta, state.Meta) {
+		m.publish(NodeUpdate, &state.Node)
+	}
+}
+
+// compareIncarnation orders two incarnation numbers, returning a negative
+// number if a is older than b, 0 if they are the same, and a positive number
+// if a is newer. This uses Config.IncarnationComparator if one is set.
+func (m *Memberlist) compareIncarnation(a, b uint32) int {
+	if m.config.IncarnationComparator != nil {
+		return m.config.IncarnationComparator(a, b)
+	}
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// metaTieBreak is called when an alive message for a node has the same
+// incarnation as the one we have. These should never disagree, since the node
+// bumps its incarnation whenever its meta data changes, so conflicting meta
+// data points to a bug or a spoofing attempt. Returns true if the message
+// should replace what we have, which is decided by comparing the meta data so
+// that all nodes deterministically settle on the same one. This must be
+// called while the nodeLock is held.
+func (m *Memberlist) metaTieBreak(state *nodeState, a *alive) bool {
+	if state.State != stateAlive || bytes.Equal(a.Meta, state.Meta) {
+		return false
+	}
+
+	m.metricSink().IncrCounter([]string{"memberlist", "msg", "alive", "conflict"}, 1)
+	m.logger.Printf("[WARN] memberlist: Conflicting meta data for %s at incarnation %d",
+		state.Name, a.Incarnation)
+	return bytes.Compare(a.Meta, state.Meta) > 0
+}
+
+// renameNode moves an existing node over to the name given in the alive
+// message, which has the same ID, and drops anything we were tracking under
+// the old name. If the application still knows the node by its old name,
+// that's announced as a leave here, and aliveNode takes care of announcing
+// the join under the new name. This must be called while the nodeLock is
+// held.
+func (m *Memberlist) renameNode(state *nodeState, a *alive) {
+	m.logger.Printf("[INFO] memberlist: Node %s with ID %s is now known as %s", state.Name, a.ID, a.Node)
+
+	m.probeMissLock.Lock()
+	delete(m.probeMisses, state.Name)
+	m.probeMissLock.Unlock()
+
+	delete(m.metaUpdates, state.Name)
+	delete(m.nodeMap, state.Name)
+	delete(m.nodeTimers, state.Name)
+	if state.State == stateDead {
+		delete(m.deadAddrs, state.Address())
+	}
+	if state.State != stateDead || m.cancelLeave(state.Name) {
+		old := state.Node
+		m.notifyLeave(&old)
+	}
+
+	state.Name = a.Node
+	state.Addr = a.Addr
+	state.Port = a.Port
+	m.nodeMap[a.Node] = state
+}
+
+// deregisterNode removes a node that's being reaped from the lookup maps.
+// This must be called while the nodeLock is held.
+func (m *Memberlist) deregisterNode(state *nodeState) {
+	m.probeMissLock.Lock()
+	delete(m.probeMisses, state.Name)
+	m.probeMissLock.Unlock()
+
+	delete(m.metaUpdates, state.Name)
+	delete(m.nodeMap, state.Name)
+	delete(m.deadAddrs, state.Address())
+	if state.ID != "" && m.nodeIDs[state.ID] == state {
+		delete(m.nodeIDs, state.ID)
+	}
+}
+
+// pendingNode is a node we've heard about that's waiting to be confirmed by a
+// direct ping before it's added to the member list.
+type pendingNode struct {
+	alive     alive
+	confirmed bool
+}
+
+// confirmPending is called from aliveNode for a node we don't know about when
+// ConfirmBeforeAdd is set. This returns true if the node has been confirmed
+// and can be added. Otherwise the node is held as pending, and the first time
+// we hear about it we start a direct ping to confirm it. This must be called
+// while the nodeLock is held.
+func (m *Memberlist) confirmPending(a *alive) bool {
+	m.pendingLock.Lock()
+	defer m.pendingLock.Unlock()
+
+	p, ok := m.pendingNodes[a.Node]
+	if ok && p.confirmed {
+		delete(m.pendingNodes, a.Node)
+		return true
+	}
+
+	// Hold on to the latest alive message so that's what gets added.
+	if ok {
+		if m.compareIncarnation(a.Incarnation, p.alive.Incarnation) > 0 {
+			p.alive = *a
+		}
+		return false
+	}
+	m.pendingNodes[a.Node] = &pendingNode{alive: *a}
+	go m.confirmNode(a.Node, &net.UDPAddr{IP: a.Addr, Port: int(a.Port)})
+	return false
+}
+
+// confirmNode pings a pending node directly, and adds it to the member list if
+// it answers. Otherwise the node is dropped from the pending set.
+func (m *Memberlist) confirmNode(node string, addr net.Addr) {
+	_, err := m.Ping(node, addr)
+
+	m.pendingLock.Lock()
+	p, ok := m.pendingNodes[node]
+	if !ok {
+		m.pendingLock.Unlock()
+		return
+	}
+	if err != nil {
+		delete(m.pendingNodes, node)
+		m.pendingLock.Unlock()
+		m.logger.Printf("[DEBUG] memberlist: Dropping unconfirmed node %s: %v", node, err)
+		return
+	}
+	p.confirmed = true
+	a := p.alive
+	m.pendingLock.Unlock()
+
+	m.aliveNode(&a, nil, false)
+
+	// Clean up in case the node was rejected for some other reason, so we
+	// don't leave it confirmed for later.
+	m.pendingLock.Lock()
+	if m.pendingNodes[node] == p {
+		delete(m.pendingNodes, node)
+	}
+	m.pendingLock.Unlock()
 }
 
 // suspectNode is invoked by the network layer when we get a message
@@ -1010,7 +1942,7 @@ func (m *Memberlist) suspectNode(s *suspect) {
 	}
 
 	// Ignore old incarnation numbers
-	if s.Incarnation < state.Incarnation {
+	if m.compareIncarnation(s.Incarnation, state.Incarnation) < 0 {
 		return
 	}
 
@@ -1020,7 +1952,7 @@ func (m *Memberlist) suspectNode(s *suspect) {
 	// that's already suspect.
 	if timer, ok := m.nodeTimers[s.Node]; ok {
 		if timer.Confirm(s.From) {
-			m.encodeAndBroadcast(s.Node, suspectMsg, s)
+			m.rebroadcast(s.From, s.Node, suspectMsg, s, nil)
 		}
 		return
 	}
@@ -1036,17 +1968,19 @@ func (m *Memberlist) suspectNode(s *suspect) {
 		m.logger.Printf("[WARN] memberlist: Refuting a suspect message (from: %s)", s.From)
 		return // Do not mark ourself suspect
 	} else {
-		m.encodeAndBroadcast(s.Node, suspectMsg, s)
+		m.rebroadcast(s.From, s.Node, suspectMsg, s, nil)
 	}
 
 	// Update metrics
-	metrics.IncrCounter([]string{"memberlist", "msg", "suspect"}, 1)
+	m.metricSink().IncrCounter([]string{"memberlist", "msg", "suspect"}, 1)
 
 	// Update the state
 	state.Incarnation = s.Incarnation
 	state.State = stateSuspect
 	changeTime := time.Now()
 	state.StateChange = changeTime
+	state.UpdatedBy = s.From
+	m.writeEvent(eventSuspect, &state.Node, state.Incarnation)
 
 	// Setup a suspicion timer. Given that we don't have any known phase
 	// relationship with our peers, we set up k such that we hit the nominal
@@ -1066,19 +2000,27 @@ func (m *Memberlist) suspectNode(s *suspect) {
 	min := suspicionTimeout(m.config.SuspicionMult, n, m.config.ProbeInterval)
 	max := time.Duration(m.config.SuspicionMaxTimeoutMult) * min
 	fn := func(numConfirmations int) {
+		// Grab everything we need from the state while we hold the lock,
+		// since it can change underneath us as soon as we let go. If the
+		// incarnation moves on in the meantime, deadNode will see that the
+		// node has refuted and ignore us.
+		var d dead
 		m.nodeLock.Lock()
 		state, ok := m.nodeMap[s.Node]
 		timeout := ok && state.State == stateSuspect && state.StateChange == changeTime
+		if timeout {
+			d = dead{Incarnation: state.Incarnation, Node: state.Name, From: m.config.Name}
+		}
 		m.nodeLock.Unlock()
 
 		if timeout {
 			if k > 0 && numConfirmations < k {
-				metrics.IncrCounter([]string{"memberlist", "degraded", "timeout"}, 1)
+				m.metricSink().IncrCounter([]string{"memberlist", "degraded", "timeout"}, 1)
 			}
 
+			m.detectTimes.Add(time.Since(changeTime))
 			m.logger.Printf("[INFO] memberlist: Marking %s as failed, suspect timeout reached (%d peer confirmations)",
-				state.Name, numConfirmations)
-			d := dead{Incarnation: state.Incarnation, Node: state.Name, From: m.config.Name}
+				d.Node, numConfirmations)
 			m.deadNode(&d)
 		}
 	}
@@ -1098,7 +2040,7 @@ func (m *Memberlist) deadNode(d *dead) {
 	}
 
 	// Ignore old incarnation numbers
-	if d.Incarnation < state.Incarnation {
+	if m.compareIncarnation(d.Incarnation, state.Incarnation) < 0 {
 		return
 	}
 
@@ -1122,32 +2064,197 @@ func (m *Memberlist) deadNode(d *dead) {
 		// If we are leaving, we broadcast and wait
 		m.encodeBroadcastNotify(d.Node, deadMsg, d, m.leaveBroadcast)
 	} else {
-		m.encodeAndBroadcast(d.Node, deadMsg, d)
+		m.rebroadcast(d.From, d.Node, deadMsg, d, nil)
 	}
 
 	// Update metrics
-	metrics.IncrCounter([]string{"memberlist", "msg", "dead"}, 1)
+	m.metricSink().IncrCounter([]string{"memberlist", "msg", "dead"}, 1)
 
 	// Update the state
 	state.Incarnation = d.Incarnation
 	state.State = stateDead
 	state.StateChange = time.Now()
+	state.UpdatedBy = d.From
+	if m.config.ReviveOnContact {
+		m.deadAddrs[state.Address()] = state.Name
+	}
+	if d.Node == d.From {
+		m.writeEvent(eventLeave, &state.Node, state.Incarnation)
+	} else {
+		m.writeEvent(eventDead, &state.Node, state.Incarnation)
+	}
+
+	// Notify of death, possibly after a grace period
+	if m.config.LeaveGrace > 0 {
+		m.deferLeave(state)
+	} else {
+		m.notifyLeave(&state.Node)
+	}
+}
+
+// checkRevive is called with the source of every packet we receive when
+// ReviveOnContact is set. If it's a node we think is dead, and we aren't
+// already trying to revive it, then we start trying.
+func (m *Memberlist) checkRevive(from net.Addr) {
+	addr := from.String()
+	m.nodeLock.RLock()
+	name, ok := m.deadAddrs[addr]
+	m.nodeLock.RUnlock()
+	if !ok {
+		return
+	}
+
+	m.reviveLock.Lock()
+	defer m.reviveLock.Unlock()
+	if _, ok := m.reviving[name]; ok {
+		return
+	}
+	m.reviving[name] = struct{}{}
+	go m.revive(name, from)
+}
+
+// revive pings a node we think is dead, and if it answers we send it our dead
+// message about it directly, so that it refutes it right away.
+func (m *Memberlist) revive(name string, addr net.Addr) {
+	defer func() {
+		m.reviveLock.Lock()
+		delete(m.reviving, name)
+		m.reviveLock.Unlock()
+	}()
 
-	// Notify of death
+	if _, err := m.Ping(name, addr); err != nil {
+		return
+	}
+
+	m.nodeLock.RLock()
+	state, ok := m.nodeMap[name]
+	isDead := ok && state.State == stateDead
+	var inc uint32
+	if isDead {
+		inc = state.Incarnation
+	}
+	m.nodeLock.RUnlock()
+	if !isDead {
+		return
+	}
+
+	m.metricSink().IncrCounter([]string{"memberlist", "revive"}, 1)
+	m.logger.Printf("[INFO] memberlist: Heard from dead node %s, asking it to refute", name)
+	d := dead{Incarnation: inc, Node: name, From: m.config.Name}
+	if err := m.encodeAndSendMsg(addr.String(), deadMsg, &d); err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to send dead message to %s: %s", addr, err)
+	}
+}
+
+// notifyLeave lets the application and any subscribers know that a node has
+// left. This must be called while the nodeLock is held.
+func (m *Memberlist) notifyLeave(node *Node) {
 	if m.config.Events != nil {
-		m.config.Events.NotifyLeave(&state.Node)
+		m.config.Events.NotifyLeave(node)
+	}
+	m.publish(NodeLeave, node)
+	m.sizeChanged()
+	if m.config.LeaveBatchCh != nil {
+		n := *node
+		m.batchLeave(&n)
+	}
+}
+
+// deferLeave arranges for the application to be told that the given dead node
+// has left once the LeaveGrace period has passed, unless it comes back before
+// then. This must be called while the nodeLock is held.
+func (m *Memberlist) deferLeave(state *nodeState) {
+	name := state.Name
+	node := state.Node
+
+	var timer *time.Timer
+	timer = time.AfterFunc(m.config.LeaveGrace, func() {
+		m.nodeLock.Lock()
+		defer m.nodeLock.Unlock()
+
+		// Make sure we weren't cancelled or replaced in the meantime.
+		if m.leaveTimers[name] != timer {
+			return
+		}
+		delete(m.leaveTimers, name)
+		m.notifyLeave(&node)
+	})
+	if old, ok := m.leaveTimers[name]; ok {
+		old.Stop()
+	}
+	m.leaveTimers[name] = timer
+}
+
+// cancelLeave cancels a deferred leave notification for the given node, and
+// returns true if there was one. This must be called while the nodeLock is
+// held.
+func (m *Memberlist) cancelLeave(name string) bool {
+	timer, ok := m.leaveTimers[name]
+	if !ok {
+		return false
+	}
+	timer.Stop()
+	delete(m.leaveTimers, name)
+	return true
+}
+
+// batchLeave adds a dead node to the pending leave batch, and arranges for
+// the batch to be delivered once the LeaveBatchWindow has passed if this is
+// the first node in it.
+func (m *Memberlist) batchLeave(node *Node) {
+	m.leaveBatchLock.Lock()
+	defer m.leaveBatchLock.Unlock()
+
+	m.leaveBatch = append(m.leaveBatch, node)
+	if len(m.leaveBatch) == 1 {
+		time.AfterFunc(m.config.LeaveBatchWindow, m.flushLeaveBatch)
+	}
+}
+
+// flushLeaveBatch delivers the pending leave batch to the LeaveBatchCh.
+func (m *Memberlist) flushLeaveBatch() {
+	m.leaveBatchLock.Lock()
+	batch := m.leaveBatch
+	m.leaveBatch = nil
+	m.leaveBatchLock.Unlock()
+
+	select {
+	case m.config.LeaveBatchCh <- batch:
+	case <-m.shutdownCh:
 	}
 }
 
 // mergeState is invoked by the network layer when we get a Push/Pull
 // state transfer
 func (m *Memberlist) mergeState(remote []pushNodeState) {
+	resolver, _ := m.config.Merge.(MergeResolver)
 	for _, r := range remote {
+		// Let the resolver settle any ties, if we have one. By default we
+		// take the peer's view of a suspect or dead node over an alive one,
+		// and otherwise keep our own.
+		if resolver != nil {
+			if winner, ok := m.resolveMerge(resolver, &r); ok {
+				if !winner {
+					continue
+				}
+				switch r.State {
+				case stateAlive:
+					m.forceAlive(&r)
+					continue
+				case stateDead:
+					d := dead{Incarnation: r.Incarnation, Node: r.Name, From: m.config.Name}
+					m.deadNode(&d)
+					continue
+				}
+			}
+		}
+
 		switch r.State {
 		case stateAlive:
 			a := alive{
 				Incarnation: r.Incarnation,
 				Node:        r.Name,
+				ID:          r.ID,
 				Addr:        r.Addr,
 				Port:        r.Port,
 				Meta:        r.Meta,
@@ -1165,3 +2272,78 @@ func (m *Memberlist) mergeState(remote []pushNodeState) {
 		}
 	}
 }
+
+// resolveMerge asks the resolver to settle a conflict between our view of a
+// node and the remote one. The second return value is false if there's no
+// conflict to settle, otherwise the first is true if the remote view wins.
+func (m *Memberlist) resolveMerge(resolver MergeResolver, r *pushNodeState) (bool, bool) {
+	m.nodeLock.RLock()
+	state, ok := m.nodeMap[r.Name]
+	var local Node
+	var localStatus NodeStatus
+	conflict := ok && r.Name != m.config.Name &&
+		m.compareIncarnation(state.Incarnation, r.Incarnation) == 0 &&
+		state.State != r.State
+	if conflict {
+		local = state.Node
+		localStatus = NodeStatus(state.State)
+	}
+	m.nodeLock.RUnlock()
+	if !conflict {
+		return false, false
+	}
+
+	remote := Node{
+		Name: r.Name,
+		Addr: r.Addr,
+		Port: r.Port,
+		Meta: r.Meta,
+	}
+	if len(r.Vsn) > 5 {
+		remote.PMin, remote.PMax, remote.PCur = r.Vsn[0], r.Vsn[1], r.Vsn[2]
+		remote.DMin, remote.DMax, remote.DCur = r.Vsn[3], r.Vsn[4], r.Vsn[5]
+	}
+	return resolver.ResolveMerge(&local, &remote, localStatus, NodeStatus(r.State)), true
+}
+
+// forceAlive marks a suspect or dead node alive again with the remote view's
+// meta data, without requiring a newer incarnation number. This is used when a
+// MergeResolver picks the remote view.
+func (m *Memberlist) forceAlive(r *pushNodeState) {
+	m.nodeLock.Lock()
+	defer m.nodeLock.Unlock()
+
+	state, ok := m.nodeMap[r.Name]
+	if !ok || m.compareIncarnation(state.Incarnation, r.Incarnation) != 0 || state.State == stateAlive {
+		return
+	}
+
+	// Clear out any suspicion timer that may be in effect.
+	delete(m.nodeTimers, r.Name)
+	delete(m.deadAddrs, state.Address())
+
+	oldState := state.State
+	oldMeta := state.Meta
+	state.Meta = r.Meta
+	state.State = stateAlive
+	state.StateChange = time.Now()
+	state.UpdatedBy = r.Name
+
+	if oldState == stateDead {
+		m.writeEvent(eventJoin, &state.Node, state.Incarnation)
+	}
+	joined := oldState == stateDead && !m.cancelLeave(state.Name)
+	if m.config.Events != nil {
+		if joined {
+			m.config.Events.NotifyJoin(&state.Node)
+		} else if !bytes.Equal(oldMeta, state.Meta) {
+			m.config.Events.NotifyUpdate(&state.Node)
+		}
+	}
+	if joined {
+		m.publish(NodeJoin, &state.Node)
+		m.sizeChanged()
+	} else if !bytes.Equal(oldMeta, state.Meta) {
+		m.publish(NodeUpdate, &state.Node)
+	}
+}
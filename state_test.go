@@ -3,7 +3,15 @@ package memberlist
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -821,6 +829,736 @@ func TestMemberList_ProbeNode(t *testing.T) {
 	}
 }
 
+func TestMemberList_ProbeNode_NewNodeGrace(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	ip1 := []byte(addr1)
+	ip2 := []byte(addr2)
+
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = time.Millisecond
+		c.ProbeInterval = 10 * time.Millisecond
+		c.NewNodeGracePeriod = time.Hour
+	})
+
+	a1 := alive{Node: addr1.String(), Addr: ip1, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a1, nil, true)
+	a2 := alive{Node: addr2.String(), Addr: ip2, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a2, nil, false)
+
+	// There's nobody at the other end, so this will fail, but only after
+	// waiting out the extended probe interval.
+	n := m1.nodeMap[addr2.String()]
+	startProbe := time.Now()
+	m1.probeNode(n)
+	probeTime := time.Now().Sub(startProbe)
+
+	if n.State != stateSuspect {
+		t.Fatalf("Expect node to be suspect")
+	}
+	if probeTime < 2*m1.config.ProbeInterval {
+		t.Fatalf("probed too quickly: %9.6f", probeTime.Seconds())
+	}
+}
+
+func TestMemberList_ProbeNode_Oversized(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	ip1 := []byte(addr1)
+	ip2 := []byte(addr2)
+
+	ping := &MockPing{}
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = time.Millisecond
+		c.ProbeInterval = 10 * time.Millisecond
+		c.Ping = ping
+	})
+	_ = HostMemberlist(addr2.String(), t, nil)
+
+	a1 := alive{Node: addr1.String(), Addr: ip1, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a1, nil, true)
+	a2 := alive{Node: addr2.String(), Addr: ip2, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a2, nil, false)
+
+	// Shrink the budget so that even a bare ping won't fit.
+	m1.config.UDPBufferSize = 8
+
+	n := m1.nodeMap[addr2.String()]
+	m1.probeNode(n)
+
+	// The ping should never have gone out, and we shouldn't blame the
+	// other node for that.
+	if ping.other != nil {
+		t.Fatalf("should not have pinged: %v", ping.other)
+	}
+	if n.State != stateAlive {
+		t.Fatalf("Expect node to be alive")
+	}
+}
+
+func TestMemberList_CheckPingSize(t *testing.T) {
+	m := &Memberlist{config: &Config{UDPBufferSize: 100}}
+
+	// Leave room for the CRC header.
+	if err := m.checkPingSize(100 - crcHeaderOverhead); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := m.checkPingSize(100 - crcHeaderOverhead + 1); err == nil {
+		t.Fatalf("expected error for an oversized ping")
+	}
+
+	// And for the encryption overhead on top of that.
+	m.config.GossipVerifyOutgoing = true
+	keyring, err := NewKeyring(nil, make([]byte, 16))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	m.config.Keyring = keyring
+	limit := 100 - crcHeaderOverhead - encryptOverhead(m.encryptionVersion())
+	if err := m.checkPingSize(limit); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := m.checkPingSize(limit + 1); err == nil {
+		t.Fatalf("expected error for an oversized ping")
+	}
+}
+
+func TestMemberList_ProbeNode_CorroborateIndirectAcks(t *testing.T) {
+	m := HostMemberlist(getBindAddr().String(), t, func(c *Config) {
+		c.CorroborateIndirectAcks = true
+	})
+	defer m.Shutdown()
+
+	m.recordProbeResult("good", true)
+	m.recordProbeResult("flaky", false)
+	if !m.relayReliable("good") || m.relayReliable("flaky") {
+		t.Fatalf("bad reliability")
+	}
+
+	timeout := ackMessage{false, nil, time.Now()}
+
+	// A reliable relay is enough on its own.
+	ackCh := make(chan ackMessage, 1)
+	relayCh := make(chan string, 2)
+	relayCh <- "good"
+	if !m.waitForCorroboration("target", ackCh, relayCh) {
+		t.Fatalf("expected reliable relay to be trusted")
+	}
+
+	// A flaky relay on its own isn't.
+	relayCh = make(chan string, 2)
+	relayCh <- "flaky"
+	ackCh <- timeout
+	if m.waitForCorroboration("target", ackCh, relayCh) {
+		t.Fatalf("expected flaky relay to need corroboration")
+	}
+
+	// But two of them agreeing is fine.
+	ackCh = make(chan ackMessage, 1)
+	relayCh = make(chan string, 2)
+	relayCh <- "flaky"
+	relayCh <- "other"
+	m.recordProbeResult("other", false)
+	if !m.waitForCorroboration("target", ackCh, relayCh) {
+		t.Fatalf("expected corroborated ack to be trusted")
+	}
+
+	// A node coming back clears its record.
+	m.recordProbeResult("flaky", true)
+	if !m.relayReliable("flaky") {
+		t.Fatalf("expected flaky relay to be reliable again")
+	}
+}
+
+func TestMemberList_ProbeNode_Trace(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	addr3 := getBindAddr()
+	ip1 := []byte(addr1)
+	ip2 := []byte(addr2)
+	ip3 := []byte(addr3)
+
+	traceCh := make(chan *ProbeTrace, 2)
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = 10 * time.Millisecond
+		c.ProbeInterval = 200 * time.Millisecond
+		c.TraceProbes = true
+		c.ProbeTraceCh = traceCh
+		c.RandSeed = 1
+	})
+	defer m1.Shutdown()
+	m2 := HostMemberlist(addr2.String(), t, nil)
+	defer m2.Shutdown()
+
+	a1 := alive{Node: addr1.String(), Addr: ip1, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a1, nil, true)
+	a2 := alive{Node: addr2.String(), Addr: ip2, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a2, nil, false)
+
+	// Node 3 never gets started.
+	a3 := alive{Node: addr3.String(), Addr: ip3, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a3, nil, false)
+
+	events := func(trace *ProbeTrace) []string {
+		var out []string
+		for _, s := range trace.Steps {
+			out = append(out, s.Event)
+		}
+		return out
+	}
+
+	m1.probeNode(m1.nodeMap[addr2.String()])
+	trace := <-traceCh
+	if trace.Node != addr2.String() {
+		t.Fatalf("bad: %s", trace)
+	}
+	if got := events(trace); !reflect.DeepEqual(got, []string{"ping-sent", "ack"}) {
+		t.Fatalf("bad: %v", got)
+	}
+
+	m1.probeNode(m1.nodeMap[addr3.String()])
+	trace = <-traceCh
+	expected := []string{"ping-sent", "timeout", "indirect-sent", "indirect-timeout", "suspect"}
+	if got := events(trace); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("bad: %v", got)
+	}
+}
+
+func TestMemberList_ProbeNode_LatencyPercentiles(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	ip1 := []byte(addr1)
+	ip2 := []byte(addr2)
+
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = 10 * time.Millisecond
+		c.ProbeInterval = 200 * time.Millisecond
+	})
+	defer m1.Shutdown()
+	m2 := HostMemberlist(addr2.String(), t, nil)
+	defer m2.Shutdown()
+
+	a1 := alive{Node: addr1.String(), Addr: ip1, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a1, nil, true)
+	a2 := alive{Node: addr2.String(), Addr: ip2, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a2, nil, false)
+
+	if ps := m1.LatencyPercentiles(); len(ps) != 0 {
+		t.Fatalf("bad: %v", ps)
+	}
+
+	n := m1.nodeMap[addr2.String()]
+	m1.probeNode(n)
+
+	ps := m1.LatencyPercentiles()
+	for _, key := range []string{"rtt-p50", "rtt-p95", "rtt-p99"} {
+		if _, ok := ps[key]; !ok {
+			t.Fatalf("missing %q: %v", key, ps)
+		}
+	}
+	if _, ok := ps["detect-p50"]; ok {
+		t.Fatalf("bad: %v", ps)
+	}
+}
+
+func TestMemberList_ProbeNode_OnProbe(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	ip1 := []byte(addr1)
+	ip2 := []byte(addr2)
+
+	var probed []string
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = time.Millisecond
+		c.ProbeInterval = 10 * time.Millisecond
+		c.OnProbe = func(node *Node) {
+			probed = append(probed, node.Name)
+		}
+	})
+	_ = HostMemberlist(addr2.String(), t, nil)
+
+	a1 := alive{Node: addr1.String(), Addr: ip1, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a1, nil, true)
+	a2 := alive{Node: addr2.String(), Addr: ip2, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a2, nil, false)
+
+	// We should never be asked about ourselves, only about the peer.
+	for i := 0; i < 4; i++ {
+		m1.probe()
+	}
+	if len(probed) == 0 {
+		t.Fatalf("bad: %v", probed)
+	}
+	for _, name := range probed {
+		if name != addr2.String() {
+			t.Fatalf("bad: %v", probed)
+		}
+	}
+}
+
+func TestMemberList_Probe_Concurrency(t *testing.T) {
+	var lock sync.Mutex
+	probed := make(map[string]int)
+	self := getBindAddr()
+	m := HostMemberlist(self.String(), t, func(c *Config) {
+		c.ProbeTimeout = 10 * time.Millisecond
+		c.ProbeInterval = 100 * time.Millisecond
+		c.ProbeConcurrency = 2
+		c.OnProbe = func(node *Node) {
+			lock.Lock()
+			probed[node.Name]++
+			lock.Unlock()
+		}
+	})
+	a := alive{Node: self.String(), Addr: []byte(self), Port: 7946, Incarnation: 1}
+	m.aliveNode(&a, nil, true)
+
+	for i := 0; i < 3; i++ {
+		addr := getBindAddr()
+		_ = HostMemberlist(addr.String(), t, nil)
+		a := alive{Node: addr.String(), Addr: []byte(addr), Port: 7946, Incarnation: 1}
+		m.aliveNode(&a, nil, false)
+	}
+
+	// Each round should probe two different nodes.
+	m.probe()
+	lock.Lock()
+	if len(probed) != 2 {
+		t.Fatalf("expected two nodes to be probed, got %v", probed)
+	}
+	lock.Unlock()
+
+	// We shouldn't probe a node twice in the same round, even if we
+	// could take on more. Start from the top of the rotation so the
+	// shuffle at the wrap around can't bring a peer up twice before
+	// we've seen the others.
+	probed = make(map[string]int)
+	m.config.ProbeConcurrency = 10
+	m.probeIndex = 0
+	m.probe()
+	lock.Lock()
+	defer lock.Unlock()
+	if len(probed) != 3 {
+		t.Fatalf("expected all three peers to be probed, got %v", probed)
+	}
+	for name, n := range probed {
+		if n != 1 {
+			t.Fatalf("expected %s to be probed once, got %d", name, n)
+		}
+	}
+}
+
+func TestMemberList_Probe_ResetNodesShrinks(t *testing.T) {
+	m := GetMemberlist(t)
+	m.config.GossipToTheDeadTime = 0
+
+	for i := 0; i < 5; i++ {
+		a := alive{Node: fmt.Sprintf("live%d", i), Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+		m.aliveNode(&a, nil, false)
+	}
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("dead%d", i)
+		a := alive{Node: name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+		m.aliveNode(&a, nil, false)
+		d := dead{Node: name, Incarnation: 1, From: "other"}
+		m.deadNode(&d)
+	}
+
+	// Start near the end of the list and reap the dead nodes out from
+	// under the rotation while it's walking.
+	m.probeIndex = len(m.nodes) - 1
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			m.resetNodes()
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		node, ok := m.nextProbeTarget(false)
+		if !ok {
+			t.Fatalf("expected a node to probe")
+		}
+		if node.State == stateDead {
+			t.Fatalf("should not probe dead node %s", node.Name)
+		}
+	}
+	<-done
+}
+
+func TestMemberList_IndirectRelays_Zones(t *testing.T) {
+	m := GetMemberlist(t)
+	m.config.NodeZone = func(n *Node) string {
+		return string(n.Meta)
+	}
+
+	nodes := map[string]string{
+		"target": "a",
+		"a1":     "a",
+		"a2":     "a",
+		"b1":     "b",
+		"c1":     "c",
+		"none":   "",
+	}
+	for name, zone := range nodes {
+		a := alive{Node: name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Meta: []byte(zone)}
+		m.aliveNode(&a, nil, false)
+	}
+	target := m.nodeMap["target"]
+
+	relays := func() map[string]struct{} {
+		names := make(map[string]struct{})
+		for _, n := range m.indirectRelays(target) {
+			names[n.Name] = struct{}{}
+		}
+		return names
+	}
+
+	// Only nodes from other zones should be picked when there are enough.
+	m.config.IndirectChecks = 2
+	for i := 0; i < 10; i++ {
+		if got := relays(); !reflect.DeepEqual(got, map[string]struct{}{"b1": {}, "c1": {}}) {
+			t.Fatalf("bad relays: %v", got)
+		}
+	}
+
+	// Otherwise the rest get filled in from the other nodes.
+	m.config.IndirectChecks = 4
+	got := relays()
+	if len(got) != 4 {
+		t.Fatalf("bad relays: %v", got)
+	}
+	for _, name := range []string{"b1", "c1"} {
+		if _, ok := got[name]; !ok {
+			t.Fatalf("expected %s to be picked: %v", name, got)
+		}
+	}
+	if _, ok := got["target"]; ok {
+		t.Fatalf("target should not relay its own probe: %v", got)
+	}
+}
+
+func TestMemberList_RandSeed(t *testing.T) {
+	order := func(seed int64) []string {
+		m := HostMemberlist(getBindAddr().String(), t, func(c *Config) {
+			c.RandSeed = seed
+		})
+		defer m.Shutdown()
+
+		for i := 0; i < 10; i++ {
+			a := alive{Node: fmt.Sprintf("test%d", i), Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+			m.aliveNode(&a, nil, false)
+		}
+		m.resetNodes()
+
+		var names []string
+		for _, n := range m.nodes {
+			names = append(names, n.Name)
+		}
+		for _, n := range kRandomNodes(m.rng, 3, m.nodes, nil) {
+			names = append(names, n.Name)
+		}
+		return names
+	}
+
+	// The same seed should make the same choices.
+	first := order(42)
+	if second := order(42); !reflect.DeepEqual(first, second) {
+		t.Fatalf("expected the same order, got %v and %v", first, second)
+	}
+}
+
+func TestMemberList_Probe_OnProbeSkip(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	addr3 := getBindAddr()
+	ip1 := []byte(addr1)
+	ip2 := []byte(addr2)
+	ip3 := []byte(addr3)
+
+	skipped := make(map[string]string)
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = time.Millisecond
+		c.ProbeInterval = 10 * time.Millisecond
+		c.OnProbeSkip = func(node *Node, reason string) {
+			skipped[node.Name] = reason
+		}
+	})
+	_ = HostMemberlist(addr2.String(), t, nil)
+
+	a1 := alive{Node: addr1.String(), Addr: ip1, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a1, nil, true)
+	a2 := alive{Node: addr2.String(), Addr: ip2, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a2, nil, false)
+	a3 := alive{Node: addr3.String(), Addr: ip3, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a3, nil, false)
+	d := dead{Node: addr3.String(), Incarnation: 1}
+	m1.deadNode(&d)
+
+	// A full rotation should pass over ourselves and the dead node.
+	for i := 0; i < 3; i++ {
+		m1.probe()
+	}
+	if len(skipped) != 2 {
+		t.Fatalf("bad: %v", skipped)
+	}
+	if skipped[addr1.String()] != "self" || skipped[addr3.String()] != "dead" {
+		t.Fatalf("bad: %v", skipped)
+	}
+}
+
+func TestMemberList_Probe_Alone(t *testing.T) {
+	var skipped []string
+	m := GetMemberlist(t)
+	m.config.OnProbeSkip = func(node *Node, reason string) {
+		skipped = append(skipped, reason)
+	}
+	m.setAlive()
+	defer m.Shutdown()
+
+	// With no one else around we shouldn't even consider ourselves.
+	for i := 0; i < 3; i++ {
+		m.probe()
+	}
+	if len(skipped) != 0 {
+		t.Fatalf("bad: %v", skipped)
+	}
+	if m.probeIndex != 0 {
+		t.Fatalf("bad: %d", m.probeIndex)
+	}
+}
+
+func TestMemberList_Probe_ShrinkingNodes(t *testing.T) {
+	m := GetMemberlist(t)
+	m.config.ProbeTimeout = time.Millisecond
+	m.config.ProbeInterval = 5 * time.Millisecond
+	m.setAlive()
+	defer m.Shutdown()
+
+	// Keep growing and shrinking the node list underneath the probe
+	// rotation. This is mostly useful when run with -race.
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		for i := 0; i < 50; i++ {
+			for j := 0; j < 10; j++ {
+				name := fmt.Sprintf("test%d", j)
+				a := alive{Node: name, Addr: []byte{127, 0, 0, 1}, Port: 1, Incarnation: uint32(i + 1)}
+				m.aliveNode(&a, nil, false)
+				d := dead{Node: name, Incarnation: uint32(i + 1)}
+				m.deadNode(&d)
+			}
+			m.ClearDead()
+		}
+	}()
+
+	for {
+		select {
+		case <-doneCh:
+			return
+		default:
+			m.probe()
+		}
+	}
+}
+
+func TestMemberList_ProbeWAN(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	addr3 := getBindAddr()
+	ip1 := []byte(addr1)
+	ip2 := []byte(addr2)
+	ip3 := []byte(addr3)
+
+	var probed []string
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = time.Millisecond
+		c.ProbeInterval = 10 * time.Millisecond
+		c.WANCIDRs = []*net.IPNet{
+			&net.IPNet{IP: addr2, Mask: net.CIDRMask(32, 32)},
+		}
+		c.WANProbeInterval = 100 * time.Millisecond
+		c.OnProbe = func(node *Node) {
+			probed = append(probed, node.Name)
+		}
+	})
+	_ = HostMemberlist(addr2.String(), t, nil)
+	_ = HostMemberlist(addr3.String(), t, nil)
+
+	a1 := alive{Node: addr1.String(), Addr: ip1, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a1, nil, true)
+	a2 := alive{Node: addr2.String(), Addr: ip2, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a2, nil, false)
+	a3 := alive{Node: addr3.String(), Addr: ip3, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a3, nil, false)
+
+	m1.nodeLock.RLock()
+	wan2, wan3 := m1.nodeMap[addr2.String()].WAN, m1.nodeMap[addr3.String()].WAN
+	m1.nodeLock.RUnlock()
+	if !wan2 || wan3 {
+		t.Fatalf("bad: %v %v", wan2, wan3)
+	}
+
+	// The regular rotation should only ever see the LAN peer.
+	for i := 0; i < 4; i++ {
+		m1.probe()
+	}
+	if len(probed) == 0 {
+		t.Fatalf("bad: %v", probed)
+	}
+	for _, name := range probed {
+		if name != addr3.String() {
+			t.Fatalf("bad: %v", probed)
+		}
+	}
+
+	// The WAN rotation should only ever see the WAN peer.
+	probed = nil
+	for i := 0; i < 4; i++ {
+		m1.probeWAN()
+	}
+	if len(probed) == 0 {
+		t.Fatalf("bad: %v", probed)
+	}
+	for _, name := range probed {
+		if name != addr2.String() {
+			t.Fatalf("bad: %v", probed)
+		}
+	}
+}
+
+func TestMemberList_CheckIsolation(t *testing.T) {
+	isolated := 0
+	m := &Memberlist{config: &Config{
+		Name:             "test",
+		IsolationTimeout: 10 * time.Millisecond,
+		OnIsolated: func() {
+			isolated++
+		},
+	}}
+	m.nodes = []*nodeState{
+		&nodeState{Node: Node{Name: "test"}, State: stateAlive},
+	}
+
+	// The first check only starts the clock.
+	m.checkIsolation()
+	if isolated != 0 {
+		t.Fatalf("bad: %d", isolated)
+	}
+
+	// Once the timeout has passed we should fire on every check.
+	time.Sleep(15 * time.Millisecond)
+	m.checkIsolation()
+	m.checkIsolation()
+	if isolated != 2 {
+		t.Fatalf("bad: %d", isolated)
+	}
+
+	// Seeing a live peer resets everything.
+	m.nodes = append(m.nodes, &nodeState{Node: Node{Name: "test2"}, State: stateAlive})
+	m.checkIsolation()
+	if isolated != 2 || !m.aloneSince.IsZero() {
+		t.Fatalf("bad: %d %v", isolated, m.aloneSince)
+	}
+}
+
+func TestMemberList_CheckIsolation_Reseed(t *testing.T) {
+	m1 := GetMemberlist(t)
+	m1.setAlive()
+	defer m1.Shutdown()
+
+	c := testConfig()
+	c.BindPort = m1.config.BindPort
+	c.IsolationTimeout = 10 * time.Millisecond
+	c.ReseedOnIsolation = true
+	c.ReseedNodes = []string{"127.0.0.1:1"}
+	c.ReseedMaxBackoff = 25 * time.Millisecond
+	m2, err := newMemberlist(c)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	m2.setAlive()
+	defer m2.Shutdown()
+
+	// Start the clock, then fail to reseed from a bogus address.
+	m2.checkIsolation()
+	time.Sleep(15 * time.Millisecond)
+	m2.checkIsolation()
+	if m2.reseedBackoff != 10*time.Millisecond {
+		t.Fatalf("bad: %v", m2.reseedBackoff)
+	}
+
+	// We should not try again until the backoff has passed, and then
+	// the backoff should double up to the max.
+	m2.checkIsolation()
+	if m2.reseedBackoff != 10*time.Millisecond {
+		t.Fatalf("bad: %v", m2.reseedBackoff)
+	}
+	time.Sleep(15 * time.Millisecond)
+	m2.checkIsolation()
+	if m2.reseedBackoff != 20*time.Millisecond {
+		t.Fatalf("bad: %v", m2.reseedBackoff)
+	}
+	time.Sleep(25 * time.Millisecond)
+	m2.checkIsolation()
+	if m2.reseedBackoff != 25*time.Millisecond {
+		t.Fatalf("bad: %v", m2.reseedBackoff)
+	}
+
+	// Point at a real node and we should be able to rejoin.
+	m2.config.ReseedNodes = []string{m1.config.BindAddr}
+	time.Sleep(30 * time.Millisecond)
+	m2.checkIsolation()
+	if m2.IsAlone() {
+		t.Fatalf("should have reseeded")
+	}
+	if m2.reseedBackoff != 0 {
+		t.Fatalf("bad: %v", m2.reseedBackoff)
+	}
+}
+
+func TestMemberList_CheckIsolation_Reseed_NoSeeds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memberlist")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := testConfig()
+	c.IsolationTimeout = 10 * time.Millisecond
+	c.ReseedOnIsolation = true
+	m, err := newMemberlist(c)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	m.setAlive()
+	defer m.Shutdown()
+
+	// With nothing to reseed from, we should still back off.
+	m.checkIsolation()
+	time.Sleep(15 * time.Millisecond)
+	m.checkIsolation()
+	if m.reseedBackoff != 10*time.Millisecond {
+		t.Fatalf("bad: %v", m.reseedBackoff)
+	}
+	m.checkIsolation()
+	if m.reseedBackoff != 10*time.Millisecond {
+		t.Fatalf("bad: %v", m.reseedBackoff)
+	}
+
+	// An empty snapshot doesn't count as reseeding either.
+	m.config.SnapshotPath = filepath.Join(dir, "snapshot")
+	if err := writeSnapshot(m.config.SnapshotPath, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	time.Sleep(15 * time.Millisecond)
+	m.checkIsolation()
+	if m.reseedBackoff != 20*time.Millisecond {
+		t.Fatalf("bad: %v", m.reseedBackoff)
+	}
+}
+
 func TestMemberList_Ping(t *testing.T) {
 	addr1 := getBindAddr()
 	addr2 := getBindAddr()
@@ -859,6 +1597,80 @@ func TestMemberList_Ping(t *testing.T) {
 	}
 }
 
+func TestMemberList_PingNode(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	ip1 := []byte(addr1)
+	ip2 := []byte(addr2)
+
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = time.Millisecond
+		c.ProbeInterval = 10 * time.Second
+	})
+	m2 := HostMemberlist(addr2.String(), t, nil)
+
+	a1 := alive{Node: addr1.String(), Addr: ip1, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a1, nil, true)
+	a2 := alive{Node: addr2.String(), Addr: ip2, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a2, nil, false)
+
+	n := m1.nodeMap[addr2.String()].Node
+	rtt, err := m1.PingNode(&n, time.Second)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !(rtt > 0) {
+		t.Fatalf("bad: %v", rtt)
+	}
+
+	// A failed ping shouldn't change what we think of the node.
+	m2.Shutdown()
+	if _, err := m1.PingNode(&n, 10*time.Millisecond); err == nil {
+		t.Fatalf("expected ping to fail")
+	}
+	if state := m1.nodeMap[addr2.String()].State; state != stateAlive {
+		t.Fatalf("expected node to still be alive, got %v", state)
+	}
+}
+
+func TestMemberList_Ping_ChaosDelay(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	ip1 := []byte(addr1)
+	ip2 := []byte(addr2)
+
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeInterval = 10 * time.Second
+		c.ChaosDelayFunc = func(dest net.IP) time.Duration {
+			if dest.Equal(addr2) {
+				return 50 * time.Millisecond
+			}
+			return 0
+		}
+	})
+	defer m1.Shutdown()
+	m2 := HostMemberlist(addr2.String(), t, nil)
+	defer m2.Shutdown()
+
+	a1 := alive{Node: addr1.String(), Addr: ip1, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a1, nil, true)
+	a2 := alive{Node: addr2.String(), Addr: ip2, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a2, nil, false)
+
+	// The ping should only get there after the injected delay.
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(addr2.String(), "7946"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	rtt, err := m1.Ping(addr2.String(), addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if rtt < 50*time.Millisecond {
+		t.Fatalf("expected ping to be delayed: %v", rtt)
+	}
+}
+
 func TestMemberList_ResetNodes(t *testing.T) {
 	m := GetMemberlist(t)
 	a1 := alive{Node: "test1", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
@@ -889,6 +1701,41 @@ func TestMemberList_ResetNodes(t *testing.T) {
 	}
 }
 
+func TestMemberList_ResetNodes_ReapLimit(t *testing.T) {
+	m := GetMemberlist(t)
+	for i := 1; i <= 4; i++ {
+		a := alive{Node: fmt.Sprintf("test%d", i), Addr: []byte{127, 0, 0, byte(i)}, Incarnation: 1}
+		m.aliveNode(&a, nil, false)
+	}
+	for i := 1; i <= 3; i++ {
+		d := dead{Node: fmt.Sprintf("test%d", i), Incarnation: 1}
+		m.deadNode(&d)
+	}
+
+	// Reap test2, then test3, and hold on to test1 the longest.
+	rank := map[string]int{"test2": 0, "test3": 1, "test1": 2}
+	m.config.GossipToTheDeadTime = 0
+	m.config.ReapLimit = 1
+	m.config.ReapComparator = func(a, b *Node) bool {
+		return rank[a.Name] < rank[b.Name]
+	}
+
+	for _, name := range []string{"test2", "test3", "test1"} {
+		time.Sleep(time.Millisecond)
+		before := len(m.nodes)
+		m.resetNodes()
+		if len(m.nodes) != before-1 {
+			t.Fatalf("bad: %d", len(m.nodes))
+		}
+		if _, ok := m.nodeMap[name]; ok {
+			t.Fatalf("%s should be unmapped", name)
+		}
+	}
+	if _, ok := m.nodeMap["test4"]; !ok {
+		t.Fatalf("test4 should not be unmapped")
+	}
+}
+
 func TestMemberList_NextSeq(t *testing.T) {
 	m := &Memberlist{}
 	if m.nextSeqNo() != 1 {
@@ -900,7 +1747,7 @@ func TestMemberList_NextSeq(t *testing.T) {
 }
 
 func TestMemberList_setProbeChannels(t *testing.T) {
-	m := &Memberlist{ackHandlers: make(map[uint32]*ackHandler)}
+	m := &Memberlist{config: &Config{}, ackHandlers: make(map[uint32]*ackHandler)}
 
 	ch := make(chan ackMessage, 1)
 	m.setProbeChannels(0, ch, nil, 10*time.Millisecond)
@@ -916,7 +1763,7 @@ func TestMemberList_setProbeChannels(t *testing.T) {
 }
 
 func TestMemberList_setAckHandler(t *testing.T) {
-	m := &Memberlist{ackHandlers: make(map[uint32]*ackHandler)}
+	m := &Memberlist{config: &Config{}, ackHandlers: make(map[uint32]*ackHandler)}
 
 	f := func([]byte, time.Time) {}
 	m.setAckHandler(0, f, 10*time.Millisecond)
@@ -931,8 +1778,36 @@ func TestMemberList_setAckHandler(t *testing.T) {
 	}
 }
 
+func TestMemberList_setAckHandler_MaxPendingAcks(t *testing.T) {
+	m := &Memberlist{config: &Config{MaxPendingAcks: 1}, ackHandlers: make(map[uint32]*ackHandler)}
+
+	f := func([]byte, time.Time) {}
+	if err := m.setAckHandler(0, f, 10*time.Millisecond); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := m.setAckHandler(1, f, 10*time.Millisecond); err == nil {
+		t.Fatalf("expected handler to be refused")
+	}
+	ch := make(chan ackMessage, 1)
+	if err := m.setProbeChannels(2, ch, nil, 10*time.Millisecond); err == nil {
+		t.Fatalf("expected probe channels to be refused")
+	}
+	if n := m.PendingAcks(); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	// Once the first one is reaped there's room again.
+	time.Sleep(20 * time.Millisecond)
+	if n := m.PendingAcks(); n != 0 {
+		t.Fatalf("bad: %d", n)
+	}
+	if err := m.setAckHandler(1, f, 10*time.Millisecond); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestMemberList_invokeAckHandler(t *testing.T) {
-	m := &Memberlist{ackHandlers: make(map[uint32]*ackHandler)}
+	m := &Memberlist{config: &Config{}, ackHandlers: make(map[uint32]*ackHandler)}
 
 	// Does nothing
 	m.invokeAckHandler(ackResp{}, time.Now())
@@ -953,7 +1828,7 @@ func TestMemberList_invokeAckHandler(t *testing.T) {
 }
 
 func TestMemberList_invokeAckHandler_Channel_Ack(t *testing.T) {
-	m := &Memberlist{ackHandlers: make(map[uint32]*ackHandler)}
+	m := &Memberlist{config: &Config{}, ackHandlers: make(map[uint32]*ackHandler)}
 
 	ack := ackResp{0, []byte{0, 0, 0}}
 
@@ -989,7 +1864,7 @@ func TestMemberList_invokeAckHandler_Channel_Ack(t *testing.T) {
 }
 
 func TestMemberList_invokeAckHandler_Channel_Nack(t *testing.T) {
-	m := &Memberlist{ackHandlers: make(map[uint32]*ackHandler)}
+	m := &Memberlist{config: &Config{}, ackHandlers: make(map[uint32]*ackHandler)}
 
 	nack := nackResp{0}
 
@@ -1064,26 +1939,264 @@ func TestMemberList_AliveNode_NewNode(t *testing.T) {
 	if state.Incarnation != 1 {
 		t.Fatalf("bad incarnation")
 	}
-	if state.State != stateAlive {
-		t.Fatalf("bad state")
+	if state.State != stateAlive {
+		t.Fatalf("bad state")
+	}
+	if time.Now().Sub(state.StateChange) > time.Second {
+		t.Fatalf("bad change delta")
+	}
+
+	// Check for a join message
+	select {
+	case e := <-ch:
+		if e.Node.Name != "test" {
+			t.Fatalf("bad node name")
+		}
+	default:
+		t.Fatalf("no join message")
+	}
+
+	// Check a broad cast is queued
+	if m.broadcasts.NumQueued() != 1 {
+		t.Fatalf("expected queued message")
+	}
+}
+
+func TestMemberList_AliveNode_ConfirmBeforeAdd(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	addr3 := getBindAddr()
+	ip1 := []byte(addr1)
+	ip2 := []byte(addr2)
+	ip3 := []byte(addr3)
+
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = 10 * time.Millisecond
+		c.ConfirmBeforeAdd = true
+	})
+	m2 := HostMemberlist(addr2.String(), t, nil)
+	defer m1.Shutdown()
+	defer m2.Shutdown()
+
+	a1 := alive{Node: addr1.String(), Addr: ip1, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a1, nil, true)
+	if _, ok := m1.nodeMap[addr1.String()]; !ok {
+		t.Fatalf("should add ourselves right away")
+	}
+
+	// m2 is reachable, so it should get confirmed and added. Nothing is
+	// listening for addr3, so it should never show up.
+	a2 := alive{Node: addr2.String(), Addr: ip2, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a2, nil, false)
+	a3 := alive{Node: addr3.String(), Addr: ip3, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a3, nil, false)
+	if num := m1.NumMembers(); num != 1 {
+		t.Fatalf("bad: %d", num)
+	}
+
+	retry(t, 10, 10*time.Millisecond, func(failf func(string, ...interface{})) {
+		m1.nodeLock.RLock()
+		_, ok2 := m1.nodeMap[addr2.String()]
+		_, ok3 := m1.nodeMap[addr3.String()]
+		m1.nodeLock.RUnlock()
+
+		m1.pendingLock.Lock()
+		pending := len(m1.pendingNodes)
+		m1.pendingLock.Unlock()
+
+		if !ok2 {
+			failf("node 2 should be confirmed")
+		}
+		if ok3 {
+			failf("node 3 should not be added")
+		}
+		if pending != 0 {
+			failf("bad: %d", pending)
+		}
+	})
+}
+
+func TestMemberList_AddKnownNodes(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	addr3 := getBindAddr()
+	ip1 := []byte(addr1)
+
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = 10 * time.Millisecond
+		c.ProbeInterval = 10 * time.Millisecond
+	})
+	m2 := HostMemberlist(addr2.String(), t, nil)
+	defer m1.Shutdown()
+	defer m2.Shutdown()
+
+	a1 := alive{Node: addr1.String(), Addr: ip1, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a1, nil, true)
+
+	// m2 is reachable, so it should get added. Nothing is listening for
+	// addr3, so it should never show up.
+	m1.AddKnownNodes([]Node{
+		{Name: addr1.String(), Addr: addr1, Port: 7946},
+		{Name: addr2.String(), Addr: addr2, Port: 7946},
+		{Name: addr3.String(), Addr: addr3, Port: 7946},
+	})
+	if num := m1.NumMembers(); num != 1 {
+		t.Fatalf("bad: %d", num)
+	}
+
+	retry(t, 10, 10*time.Millisecond, func(failf func(string, ...interface{})) {
+		m1.nodeLock.RLock()
+		state2, ok2 := m1.nodeMap[addr2.String()]
+		ok2 = ok2 && state2.State == stateAlive
+		_, ok3 := m1.nodeMap[addr3.String()]
+		m1.nodeLock.RUnlock()
+
+		m1.pendingLock.Lock()
+		pending := len(m1.pendingNodes)
+		m1.pendingLock.Unlock()
+
+		if !ok2 {
+			failf("node 2 should be added")
+		}
+		if ok3 {
+			failf("node 3 should not be added")
+		}
+		if pending != 0 {
+			failf("bad: %d", pending)
+		}
+	})
+}
+
+func TestMemberList_AliveNode_Rename(t *testing.T) {
+	m := GetMemberlist(t)
+	a := alive{Node: "old", ID: "id1", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+	m.aliveNode(&a, nil, false)
+
+	if n := m.NodeByID("id1"); n == nil || n.Name != "old" {
+		t.Fatalf("bad: %v", n)
+	}
+	if n := m.NodeByID("nope"); n != nil {
+		t.Fatalf("bad: %v", n)
+	}
+
+	// Restart under a new name with the same ID.
+	a = alive{Node: "new", ID: "id1", Addr: []byte{127, 0, 0, 2}, Incarnation: 2}
+	m.aliveNode(&a, nil, false)
+
+	if len(m.nodes) != 1 || len(m.nodeMap) != 1 {
+		t.Fatalf("should rename, not add: %v", m.nodes)
+	}
+	if _, ok := m.nodeMap["old"]; ok {
+		t.Fatalf("old name should be unmapped")
+	}
+	state := m.nodeMap["new"]
+	if state.Incarnation != 2 || !state.Addr.Equal(net.IP([]byte{127, 0, 0, 2})) {
+		t.Fatalf("bad state: %v", state)
+	}
+	if n := m.NodeByID("id1"); n == nil || n.Name != "new" {
+		t.Fatalf("bad: %v", n)
+	}
+
+	// Stale messages under the old name shouldn't rename it back.
+	for _, inc := range []uint32{1, 2} {
+		a = alive{Node: "old", ID: "id1", Addr: []byte{127, 0, 0, 1}, Incarnation: inc}
+		m.aliveNode(&a, nil, false)
+
+		if _, ok := m.nodeMap["old"]; ok {
+			t.Fatalf("stale alive at %d renamed the node back", inc)
+		}
+		state := m.nodeMap["new"]
+		if state == nil || !state.Addr.Equal(net.IP([]byte{127, 0, 0, 2})) {
+			t.Fatalf("bad state: %v", state)
+		}
+	}
+
+	// The node we hand back should be a copy.
+	n := m.NodeByID("id1")
+	n.Name = "mutated"
+	if n := m.NodeByID("id1"); n == nil || n.Name != "new" {
+		t.Fatalf("bad: %v", n)
+	}
+
+	// Reaping should clean up the ID as well.
+	d := dead{Node: "new", Incarnation: 2}
+	m.deadNode(&d)
+	if num := m.ClearDead(); num != 1 {
+		t.Fatalf("bad: %d", num)
+	}
+	if n := m.NodeByID("id1"); n != nil {
+		t.Fatalf("bad: %v", n)
+	}
+}
+
+func TestMemberList_AliveNode_Rename_Events(t *testing.T) {
+	eventCh := make(chan NodeEvent, 4)
+	m := GetMemberlist(t)
+	m.config.Events = &ChannelEventDelegate{eventCh}
+
+	a := alive{Node: "old", ID: "id1", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+	m.aliveNode(&a, nil, false)
+	if e := <-eventCh; e.Event != NodeJoin || e.Node.Name != "old" {
+		t.Fatalf("bad: %v", e)
+	}
+	m.probeMisses["old"] = 1
+	m.metaUpdates["old"] = &metaUpdateWindow{start: time.Now()}
+
+	// The rename should look like the old name leaving and the new name
+	// joining, and nothing should be left under the old name.
+	a = alive{Node: "new", ID: "id1", Addr: []byte{127, 0, 0, 2}, Incarnation: 2}
+	m.aliveNode(&a, nil, false)
+	if e := <-eventCh; e.Event != NodeLeave || e.Node.Name != "old" {
+		t.Fatalf("bad: %v", e)
+	}
+	if e := <-eventCh; e.Event != NodeJoin || e.Node.Name != "new" {
+		t.Fatalf("bad: %v", e)
+	}
+	if _, ok := m.probeMisses["old"]; ok {
+		t.Fatalf("probe misses should be cleared")
+	}
+	if _, ok := m.metaUpdates["old"]; ok {
+		t.Fatalf("meta updates should be cleared")
+	}
+}
+
+func TestMemberList_AliveNode_Rename_LeaveGrace(t *testing.T) {
+	eventCh := make(chan NodeEvent, 4)
+	m := GetMemberlist(t)
+	m.config.Events = &ChannelEventDelegate{eventCh}
+	m.config.LeaveGrace = 50 * time.Millisecond
+	m.config.ReviveOnContact = true
+
+	a := alive{Node: "old", ID: "id1", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+	m.aliveNode(&a, nil, false)
+	if e := <-eventCh; e.Event != NodeJoin {
+		t.Fatalf("bad: %v", e)
+	}
+	d := dead{Node: "old", Incarnation: 1}
+	m.deadNode(&d)
+
+	// Renaming within the grace period should announce the leave right
+	// away instead of leaving the old timer to fire later.
+	a = alive{Node: "new", ID: "id1", Addr: []byte{127, 0, 0, 2}, Incarnation: 2}
+	m.aliveNode(&a, nil, false)
+	if e := <-eventCh; e.Event != NodeLeave || e.Node.Name != "old" {
+		t.Fatalf("bad: %v", e)
+	}
+	if e := <-eventCh; e.Event != NodeJoin || e.Node.Name != "new" {
+		t.Fatalf("bad: %v", e)
 	}
-	if time.Now().Sub(state.StateChange) > time.Second {
-		t.Fatalf("bad change delta")
+	if len(m.leaveTimers) != 0 {
+		t.Fatalf("bad: %v", m.leaveTimers)
+	}
+	if len(m.deadAddrs) != 0 {
+		t.Fatalf("bad: %v", m.deadAddrs)
 	}
 
-	// Check for a join message
+	time.Sleep(100 * time.Millisecond)
 	select {
-	case e := <-ch:
-		if e.Node.Name != "test" {
-			t.Fatalf("bad node name")
-		}
+	case e := <-eventCh:
+		t.Fatalf("unexpected event: %v", e)
 	default:
-		t.Fatalf("no join message")
-	}
-
-	// Check a broad cast is queued
-	if m.broadcasts.NumQueued() != 1 {
-		t.Fatalf("expected queued message")
 	}
 }
 
@@ -1170,6 +2283,44 @@ func TestMemberList_AliveNode_Idempotent(t *testing.T) {
 	}
 }
 
+func TestMemberList_AliveNode_SteadyState(t *testing.T) {
+	m := GetMemberlist(t)
+
+	var remote []pushNodeState
+	for i := 0; i < 3; i++ {
+		a := alive{Node: fmt.Sprintf("test%d", i), Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Meta: []byte("meta")}
+		m.aliveNode(&a, nil, false)
+		remote = append(remote, pushNodeState{
+			Name:        a.Node,
+			Addr:        a.Addr,
+			Meta:        a.Meta,
+			Incarnation: a.Incarnation,
+			State:       stateAlive,
+		})
+	}
+	m.broadcasts.Reset()
+
+	// Hearing the same thing again, by gossip or push/pull, shouldn't
+	// send anything back out.
+	for i := 0; i < 5; i++ {
+		for _, r := range remote {
+			a := alive{Node: r.Name, Addr: r.Addr, Meta: r.Meta, Incarnation: r.Incarnation}
+			m.aliveNode(&a, nil, false)
+		}
+		m.mergeState(remote)
+	}
+	if num := m.broadcasts.NumQueued(); num != 0 {
+		t.Fatalf("expected no queued messages, got %d", num)
+	}
+
+	// But a newer incarnation should.
+	a := alive{Node: "test0", Addr: []byte{127, 0, 0, 1}, Incarnation: 2, Meta: []byte("meta")}
+	m.aliveNode(&a, nil, false)
+	if num := m.broadcasts.NumQueued(); num != 1 {
+		t.Fatalf("expected one queued message, got %d", num)
+	}
+}
+
 // Serf Bug: GH-58, Meta data does not update
 func TestMemberList_AliveNode_ChangeMeta(t *testing.T) {
 	ch := make(chan NodeEvent, 1)
@@ -1216,6 +2367,40 @@ func TestMemberList_AliveNode_ChangeMeta(t *testing.T) {
 
 }
 
+func TestMemberList_AliveNode_ConflictingMeta(t *testing.T) {
+	m := GetMemberlist(t)
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Meta: []byte("val2"), Incarnation: 1}
+	m.aliveNode(&a, nil, false)
+	state := m.nodeMap["test"]
+
+	// A smaller meta at the same incarnation should lose.
+	a.Meta = []byte("val1")
+	m.aliveNode(&a, nil, false)
+	if !bytes.Equal(state.Meta, []byte("val2")) {
+		t.Fatalf("bad: %s", state.Meta)
+	}
+
+	// A larger one should win, no matter which order they arrive in.
+	a.Meta = []byte("val3")
+	m.aliveNode(&a, nil, false)
+	if !bytes.Equal(state.Meta, []byte("val3")) {
+		t.Fatalf("bad: %s", state.Meta)
+	}
+	if state.Incarnation != 1 || state.State != stateAlive {
+		t.Fatalf("bad: %#v", state)
+	}
+
+	// A suspect node still needs a newer incarnation to come back.
+	s := suspect{Node: "test", Incarnation: 1}
+	m.suspectNode(&s)
+	a.Meta = []byte("val4")
+	m.aliveNode(&a, nil, false)
+	if state.State != stateSuspect || !bytes.Equal(state.Meta, []byte("val3")) {
+		t.Fatalf("bad: %#v", state)
+	}
+}
+
 func TestMemberList_AliveNode_Refute(t *testing.T) {
 	m := GetMemberlist(t)
 	a := alive{Node: m.config.Name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
@@ -1262,6 +2447,34 @@ func TestMemberList_SuspectNode_NoNode(t *testing.T) {
 	}
 }
 
+func TestMemberList_SuspectNode_TimeoutRace(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	m.config.ProbeInterval = time.Millisecond
+	m.config.SuspicionMult = 1
+	m.config.SuspicionMaxTimeoutMult = 1
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+	m.aliveNode(&a, nil, false)
+
+	// Keep suspecting the node and having it refute, so suspicion timers
+	// fire while the node's state is changing. Run this with -race to make
+	// sure the timeout doesn't touch the state without holding the lock.
+	for inc := uint32(1); inc < 50; inc++ {
+		s := suspect{Node: "test", Incarnation: inc, From: "other"}
+		m.suspectNode(&s)
+		time.Sleep(time.Duration(inc%3) * time.Millisecond)
+		a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: inc + 1}
+		m.aliveNode(&a, nil, false)
+	}
+
+	m.nodeLock.RLock()
+	state := m.nodeMap["test"].State
+	m.nodeLock.RUnlock()
+	if state != stateAlive {
+		t.Fatalf("bad state: %v", state)
+	}
+}
+
 func TestMemberList_SuspectNode(t *testing.T) {
 	m := GetMemberlist(t)
 	m.config.ProbeInterval = time.Millisecond
@@ -1319,6 +2532,147 @@ func TestMemberList_SuspectNode(t *testing.T) {
 	}
 }
 
+func TestMemberList_SuspectNode_BroadcastFilter(t *testing.T) {
+	m := GetMemberlist(t)
+	m.config.BroadcastFilter = func(msgType int, node string) bool {
+		return !(messageType(msgType) == suspectMsg && node == "flaky")
+	}
+
+	for _, name := range []string{"flaky", "test"} {
+		a := alive{Node: name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+		m.aliveNode(&a, nil, false)
+	}
+	m.broadcasts.Reset()
+
+	s := suspect{Node: "flaky", Incarnation: 1}
+	m.suspectNode(&s)
+
+	// The state should still change, but nothing should be queued.
+	if m.nodeMap["flaky"].State != stateSuspect {
+		t.Fatalf("Bad state")
+	}
+	if m.broadcasts.NumQueued() != 0 {
+		t.Fatalf("expected no queued messages")
+	}
+
+	// Other nodes are not affected by the filter.
+	s = suspect{Node: "test", Incarnation: 1}
+	m.suspectNode(&s)
+	if m.broadcasts.NumQueued() != 1 {
+		t.Fatalf("expected only one queued message")
+	}
+}
+
+func TestMemberList_SuspectNode_MaxRebroadcasts(t *testing.T) {
+	m := GetMemberlist(t)
+	m.config.MaxRebroadcastsPerSec = 2
+
+	for _, name := range []string{"test1", "test2", "test3", "test4"} {
+		a := alive{Node: name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+		m.aliveNode(&a, nil, false)
+	}
+	m.broadcasts.Reset()
+	m.rebroadcastStart = time.Time{}
+
+	// Only the first two suspicions from other nodes should be re-gossiped.
+	for _, name := range []string{"test1", "test2", "test3"} {
+		s := suspect{Node: name, Incarnation: 1, From: "other"}
+		m.suspectNode(&s)
+	}
+	if m.nodeMap["test3"].State != stateSuspect {
+		t.Fatalf("Bad state")
+	}
+	if m.broadcasts.NumQueued() != 2 {
+		t.Fatalf("expected two queued messages, got %d", m.broadcasts.NumQueued())
+	}
+
+	// Our own suspicions always go out.
+	s := suspect{Node: "test4", Incarnation: 1, From: m.config.Name}
+	m.suspectNode(&s)
+	if m.broadcasts.NumQueued() != 3 {
+		t.Fatalf("expected three queued messages, got %d", m.broadcasts.NumQueued())
+	}
+}
+
+func TestMemberList_AliveNode_MaxMetaUpdates(t *testing.T) {
+	m := GetMemberlist(t)
+	m.config.MaxMetaUpdatesPerNodePerSec = 2
+
+	// Broadcasts about the same node invalidate each other, so look at
+	// which incarnation is left in the queue.
+	queued := func() uint32 {
+		if num := m.broadcasts.NumQueued(); num != 1 {
+			t.Fatalf("expected one queued message, got %d", num)
+		}
+		var a alive
+		if err := decode(m.broadcasts.bcQueue[0].b.Message()[1:], &a); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return a.Incarnation
+	}
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+	m.aliveNode(&a, nil, false)
+
+	// Only the first two meta changes should be re-gossiped, but all of
+	// them should be applied.
+	for i := 2; i <= 4; i++ {
+		a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: uint32(i), Meta: []byte{byte(i)}}
+		m.aliveNode(&a, nil, false)
+	}
+	if state := m.nodeMap["test"]; state.Incarnation != 4 || !bytes.Equal(state.Meta, []byte{4}) {
+		t.Fatalf("expected the latest update to be applied, got %v", state)
+	}
+	if inc := queued(); inc != 3 {
+		t.Fatalf("expected incarnation 3 to be queued, got %d", inc)
+	}
+
+	// Refreshes that don't change the meta data aren't limited.
+	a = alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 5, Meta: []byte{4}}
+	m.aliveNode(&a, nil, false)
+	if inc := queued(); inc != 5 {
+		t.Fatalf("expected incarnation 5 to be queued, got %d", inc)
+	}
+
+	// Once the window rolls over, updates go out again.
+	m.metaUpdates["test"].start = time.Time{}
+	a = alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 6, Meta: []byte{6}}
+	m.aliveNode(&a, nil, false)
+	if inc := queued(); inc != 6 {
+		t.Fatalf("expected incarnation 6 to be queued, got %d", inc)
+	}
+}
+
+func TestMemberList_Broadcasts_Coalesce(t *testing.T) {
+	m := GetMemberlist(t)
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+	m.aliveNode(&a, nil, false)
+
+	// Flap the node a few times, only the latest state should be left to
+	// gossip.
+	for i := uint32(1); i <= 5; i++ {
+		s := suspect{Node: "test", Incarnation: i, From: "other"}
+		m.suspectNode(&s)
+		a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: i + 1}
+		m.aliveNode(&a, nil, false)
+	}
+
+	if num := m.broadcasts.NumQueued(); num != 1 {
+		t.Fatalf("expected one queued message, got %d", num)
+	}
+	msg := m.broadcasts.bcQueue[0].b.Message()
+	if messageType(msg[0]) != aliveMsg {
+		t.Fatalf("expected queued alive message")
+	}
+	var out alive
+	if err := decode(msg[1:], &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Incarnation != 6 {
+		t.Fatalf("expected incarnation 6, got %d", out.Incarnation)
+	}
+}
+
 func TestMemberList_SuspectNode_DoubleSuspect(t *testing.T) {
 	m := GetMemberlist(t)
 	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
@@ -1380,6 +2734,47 @@ func TestMemberList_SuspectNode_OldSuspect(t *testing.T) {
 	}
 }
 
+func TestMemberList_SuspectNode_Refute_StaleIncarnation(t *testing.T) {
+	m := GetMemberlist(t)
+	a := alive{Node: m.config.Name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+	m.aliveNode(&a, nil, true)
+
+	// Something else is circulating a much newer incarnation for us with
+	// the wrong address. We ignore it, but need to remember it.
+	a = alive{Node: m.config.Name, Addr: []byte{127, 0, 0, 2}, Incarnation: 10}
+	m.aliveNode(&a, nil, false)
+
+	state := m.nodeMap[m.config.Name]
+	if state.Incarnation != 1 {
+		t.Fatalf("bad: %d", state.Incarnation)
+	}
+
+	// The refute has to beat the stale incarnation, not just the suspicion.
+	s := suspect{Node: m.config.Name, Incarnation: 1}
+	m.suspectNode(&s)
+	if state.State != stateAlive || state.Incarnation != 11 {
+		t.Fatalf("bad: %v %d", state.State, state.Incarnation)
+	}
+}
+
+func TestMemberList_SuspectNode_Refute_FilteredIncarnation(t *testing.T) {
+	m := GetMemberlist(t)
+	a := alive{Node: m.config.Name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+	m.aliveNode(&a, nil, true)
+
+	// A newer incarnation that the Alive delegate rejects shouldn't count.
+	m.config.Alive = &CustomAliveDelegate{Ignore: "other"}
+	a = alive{Node: m.config.Name, Addr: []byte{127, 0, 0, 2}, Incarnation: 10, Vsn: make([]uint8, 6)}
+	m.aliveNode(&a, nil, false)
+
+	s := suspect{Node: m.config.Name, Incarnation: 1}
+	m.suspectNode(&s)
+	state := m.nodeMap[m.config.Name]
+	if state.State != stateAlive || state.Incarnation != 2 {
+		t.Fatalf("bad: %v %d", state.State, state.Incarnation)
+	}
+}
+
 func TestMemberList_SuspectNode_Refute(t *testing.T) {
 	m := GetMemberlist(t)
 	a := alive{Node: m.config.Name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
@@ -1451,24 +2846,178 @@ func TestMemberList_DeadNode(t *testing.T) {
 		t.Fatalf("bad change delta")
 	}
 
-	select {
-	case leave := <-ch:
-		if leave.Event != NodeLeave || leave.Node.Name != "test" {
-			t.Fatalf("bad node name")
-		}
-	default:
-		t.Fatalf("no leave message")
-	}
+	select {
+	case leave := <-ch:
+		if leave.Event != NodeLeave || leave.Node.Name != "test" {
+			t.Fatalf("bad node name")
+		}
+	default:
+		t.Fatalf("no leave message")
+	}
+
+	// Check a broad cast is queued
+	if m.broadcasts.NumQueued() != 1 {
+		t.Fatalf("expected only one queued message")
+	}
+
+	// Check its a suspect message
+	if messageType(m.broadcasts.bcQueue[0].b.Message()[0]) != deadMsg {
+		t.Fatalf("expected queued dead msg")
+	}
+}
+
+func TestMemberList_DeadNode_LeaveBatch(t *testing.T) {
+	ch := make(chan []*Node, 1)
+	m := GetMemberlist(t)
+	m.config.LeaveBatchWindow = 20 * time.Millisecond
+	m.config.LeaveBatchCh = ch
+
+	for _, name := range []string{"test1", "test2", "test3"} {
+		a := alive{Node: name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+		m.aliveNode(&a, nil, false)
+		d := dead{Node: name, Incarnation: 1}
+		m.deadNode(&d)
+	}
+
+	// Nothing should be delivered until the window closes.
+	select {
+	case batch := <-ch:
+		t.Fatalf("early batch: %v", batch)
+	default:
+	}
+
+	select {
+	case batch := <-ch:
+		if len(batch) != 3 {
+			t.Fatalf("bad batch: %v", batch)
+		}
+		for i, name := range []string{"test1", "test2", "test3"} {
+			if batch[i].Name != name {
+				t.Fatalf("bad batch: %v", batch)
+			}
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no leave batch")
+	}
+
+	// A later death starts a new batch.
+	a := alive{Node: "test1", Addr: []byte{127, 0, 0, 1}, Incarnation: 2}
+	m.aliveNode(&a, nil, false)
+	d := dead{Node: "test1", Incarnation: 2}
+	m.deadNode(&d)
+
+	select {
+	case batch := <-ch:
+		if len(batch) != 1 || batch[0].Name != "test1" {
+			t.Fatalf("bad batch: %v", batch)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no leave batch")
+	}
+}
+
+func TestMemberList_UpdatedBy(t *testing.T) {
+	m := GetMemberlist(t)
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+	m.aliveNode(&a, nil, false)
+	if from, ok := m.UpdatedBy("test"); !ok || from != "test" {
+		t.Fatalf("bad: %v %v", from, ok)
+	}
+
+	s := suspect{Node: "test", Incarnation: 1, From: "accuser"}
+	m.suspectNode(&s)
+	if from, ok := m.UpdatedBy("test"); !ok || from != "accuser" {
+		t.Fatalf("bad: %v %v", from, ok)
+	}
+
+	d := dead{Node: "test", Incarnation: 1, From: "judge"}
+	m.deadNode(&d)
+	if from, ok := m.UpdatedBy("test"); !ok || from != "judge" {
+		t.Fatalf("bad: %v %v", from, ok)
+	}
+
+	if _, ok := m.UpdatedBy("nope"); ok {
+		t.Fatalf("should not know about node")
+	}
+}
+
+func TestMemberList_DeadNode_LeaveGrace(t *testing.T) {
+	eventCh := make(chan NodeEvent, 4)
+	m := GetMemberlist(t)
+	m.config.Events = &ChannelEventDelegate{eventCh}
+	m.config.LeaveGrace = 50 * time.Millisecond
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+	m.aliveNode(&a, nil, false)
+	if e := <-eventCh; e.Event != NodeJoin {
+		t.Fatalf("bad: %v", e)
+	}
+
+	// Come back within the grace period, which shouldn't be announced.
+	d := dead{Node: "test", Incarnation: 1}
+	m.deadNode(&d)
+	a.Incarnation = 2
+	m.aliveNode(&a, nil, false)
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case e := <-eventCh:
+		t.Fatalf("unexpected event: %v", e)
+	default:
+	}
+
+	// Stay dead, which should be announced after the grace period.
+	d.Incarnation = 2
+	m.deadNode(&d)
+	select {
+	case e := <-eventCh:
+		t.Fatalf("early event: %v", e)
+	default:
+	}
+	select {
+	case e := <-eventCh:
+		if e.Event != NodeLeave || e.Node.Name != "test" {
+			t.Fatalf("bad: %v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestMemberList_DeadNode_ReviveOnContact(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	ip1 := []byte(addr1)
+	ip2 := []byte(addr2)
+
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ReviveOnContact = true
+	})
+	m2 := HostMemberlist(addr2.String(), t, nil)
+	defer m1.Shutdown()
+	defer m2.Shutdown()
+
+	a1 := alive{Node: addr1.String(), Addr: ip1, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a1, nil, true)
+	a2 := alive{Node: addr2.String(), Addr: ip2, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a2, nil, false)
+	m2.aliveNode(&a2, nil, true)
 
-	// Check a broad cast is queued
-	if m.broadcasts.NumQueued() != 1 {
-		t.Fatalf("expected only one queued message")
+	// Wrongly kill m2 and then hear from it.
+	d := dead{Node: addr2.String(), Incarnation: 1, From: addr1.String()}
+	m1.deadNode(&d)
+	if _, err := m2.Ping(addr1.String(), &net.UDPAddr{IP: addr1, Port: 7946}); err != nil {
+		t.Fatalf("err: %v", err)
 	}
 
-	// Check its a suspect message
-	if messageType(m.broadcasts.bcQueue[0].b.Message()[0]) != deadMsg {
-		t.Fatalf("expected queued dead msg")
-	}
+	// m2 should be told it's dead, and refute it.
+	retry(t, 10, 10*time.Millisecond, func(failf func(string, ...interface{})) {
+		m2.nodeLock.RLock()
+		inc := m2.nodeMap[addr2.String()].Incarnation
+		m2.nodeLock.RUnlock()
+		if inc <= 1 {
+			failf("should have refuted: %d", inc)
+		}
+	})
 }
 
 func TestMemberList_DeadNode_Double(t *testing.T) {
@@ -1521,6 +3070,114 @@ func TestMemberList_DeadNode_OldDead(t *testing.T) {
 	}
 }
 
+func TestMemberList_IncarnationComparator(t *testing.T) {
+	m := GetMemberlist(t)
+
+	// Use serial number arithmetic so incarnations can wrap around.
+	m.config.IncarnationComparator = func(a, b uint32) int {
+		return int(int32(a - b))
+	}
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: math.MaxUint32 - 1}
+	m.aliveNode(&a, nil, false)
+
+	// A wrapped incarnation is newer.
+	a = alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Meta: []byte("new")}
+	m.aliveNode(&a, nil, false)
+	state := m.nodeMap["test"]
+	if state.Incarnation != 1 || !bytes.Equal(state.Meta, []byte("new")) {
+		t.Fatalf("expected the wrapped incarnation to win, got %v", state)
+	}
+
+	// Messages from before the wrap are older, even though they're bigger.
+	a = alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: math.MaxUint32, Meta: []byte("old")}
+	m.aliveNode(&a, nil, false)
+	s := suspect{Node: "test", Incarnation: math.MaxUint32, From: "other"}
+	m.suspectNode(&s)
+	d := dead{Node: "test", Incarnation: math.MaxUint32, From: "other"}
+	m.deadNode(&d)
+	if state.Incarnation != 1 || state.State != stateAlive {
+		t.Fatalf("expected old messages to be ignored, got %v", state)
+	}
+
+	// Lookups by incarnation go by the comparator too.
+	if !m.SeenIncarnation("test", math.MaxUint32) || m.SeenIncarnation("test", 2) {
+		t.Fatalf("bad SeenIncarnation")
+	}
+	if p := m.memberKnownPayload("test", math.MaxUint32); !bytes.Equal(p, []byte{1}) {
+		t.Fatalf("bad: %v", p)
+	}
+	if p := m.memberKnownPayload("test", 2); !bytes.Equal(p, []byte{0}) {
+		t.Fatalf("bad: %v", p)
+	}
+
+	// But ones at the current incarnation still apply.
+	d = dead{Node: "test", Incarnation: 1, From: "other"}
+	m.deadNode(&d)
+	if state.State != stateDead {
+		t.Fatalf("Bad state")
+	}
+}
+
+func TestMemberList_IncarnationComparator_Refute(t *testing.T) {
+	m := GetMemberlist(t)
+	m.config.IncarnationComparator = func(a, b uint32) int {
+		return int(int32(a - b))
+	}
+	a := alive{Node: m.config.Name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+	m.aliveNode(&a, nil, true)
+
+	// Jump to just before the wrap, which the comparator would otherwise
+	// see as going backwards.
+	state := m.nodeMap[m.config.Name]
+	state.Incarnation = math.MaxUint32 - 1
+	atomic.StoreUint32(&m.incarnation, state.Incarnation)
+
+	// The accusation has wrapped around, so the refute has to as well.
+	s := suspect{Node: m.config.Name, Incarnation: 1}
+	m.suspectNode(&s)
+	if state.State != stateAlive || state.Incarnation != 2 {
+		t.Fatalf("bad: %v %d", state.State, state.Incarnation)
+	}
+}
+
+func TestMemberList_ForceLeave(t *testing.T) {
+	m := GetMemberlist(t)
+	m.setAlive()
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 10}
+	m.aliveNode(&a, nil, false)
+	m.broadcasts.Reset()
+
+	if err := m.ForceLeave(m.config.Name); err == nil {
+		t.Fatalf("expected error forcing ourselves out")
+	}
+	if err := m.ForceLeave("nope"); err == nil {
+		t.Fatalf("expected error for an unknown node")
+	}
+
+	if err := m.ForceLeave("test"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	state := m.nodeMap["test"]
+	if state.State != stateDead || state.Incarnation != 11 {
+		t.Fatalf("expected node to be dead at incarnation 11, got %v", state)
+	}
+	if num := m.broadcasts.NumQueued(); num != 1 {
+		t.Fatalf("expected one queued message, got %d", num)
+	}
+	if messageType(m.broadcasts.bcQueue[0].b.Message()[0]) != deadMsg {
+		t.Fatalf("expected queued dead message")
+	}
+
+	// Alive messages still in flight at the old incarnation don't bring
+	// it back.
+	m.aliveNode(&a, nil, false)
+	if state.State != stateDead {
+		t.Fatalf("Bad state")
+	}
+}
+
 func TestMemberList_DeadNode_AliveReplay(t *testing.T) {
 	m := GetMemberlist(t)
 	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 10}
@@ -1660,6 +3317,99 @@ func TestMemberList_MergeState(t *testing.T) {
 	}
 }
 
+type testMergeResolver struct {
+	resolve func(local, remote *Node, localStatus, remoteStatus NodeStatus) bool
+}
+
+func (r *testMergeResolver) NotifyMerge(peers []*Node) error {
+	return nil
+}
+
+func (r *testMergeResolver) ResolveMerge(local, remote *Node, localStatus, remoteStatus NodeStatus) bool {
+	return r.resolve(local, remote, localStatus, remoteStatus)
+}
+
+func TestMemberList_MergeState_Resolver(t *testing.T) {
+	m := GetMemberlist(t)
+	a1 := alive{Node: "test1", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+	m.aliveNode(&a1, nil, false)
+	a2 := alive{Node: "test2", Addr: []byte{127, 0, 0, 2}, Incarnation: 1}
+	m.aliveNode(&a2, nil, false)
+	a3 := alive{Node: "test3", Addr: []byte{127, 0, 0, 3}, Incarnation: 1}
+	m.aliveNode(&a3, nil, false)
+	a4 := alive{Node: "test4", Addr: []byte{127, 0, 0, 4}, Incarnation: 1}
+	m.aliveNode(&a4, nil, false)
+
+	for _, name := range []string{"test2", "test4"} {
+		s := suspect{Node: name, Incarnation: 1}
+		m.suspectNode(&s)
+	}
+
+	// Keep our view of test1, and take the remote view of test2 and test4.
+	// The defaults would keep test4 suspect, and do the opposite for the
+	// others. There's no conflict about test3.
+	var resolved []string
+	m.config.Merge = &testMergeResolver{func(local, remote *Node, localStatus, remoteStatus NodeStatus) bool {
+		resolved = append(resolved, remote.Name)
+		switch remote.Name {
+		case "test2":
+			return localStatus == StatusSuspect && remoteStatus == StatusAlive && string(remote.Meta) == "new"
+		case "test4":
+			return localStatus == StatusSuspect && remoteStatus == StatusDead
+		default:
+			return false
+		}
+	}}
+
+	remote := []pushNodeState{
+		pushNodeState{
+			Name:        "test1",
+			Addr:        []byte{127, 0, 0, 1},
+			Incarnation: 1,
+			State:       stateSuspect,
+		},
+		pushNodeState{
+			Name:        "test2",
+			Addr:        []byte{127, 0, 0, 2},
+			Meta:        []byte("new"),
+			Incarnation: 1,
+			State:       stateAlive,
+		},
+		pushNodeState{
+			Name:        "test3",
+			Addr:        []byte{127, 0, 0, 3},
+			Incarnation: 2,
+			State:       stateSuspect,
+		},
+		pushNodeState{
+			Name:        "test4",
+			Addr:        []byte{127, 0, 0, 4},
+			Incarnation: 1,
+			State:       stateDead,
+		},
+	}
+	m.mergeState(remote)
+
+	if !reflect.DeepEqual(resolved, []string{"test1", "test2", "test4"}) {
+		t.Fatalf("bad: %v", resolved)
+	}
+	if state := m.nodeMap["test1"]; state.State != stateAlive {
+		t.Fatalf("Bad state %v", state)
+	}
+	if state := m.nodeMap["test2"]; state.State != stateAlive || string(state.Meta) != "new" {
+		t.Fatalf("Bad state %v", state)
+	}
+	if _, ok := m.nodeTimers["test2"]; ok {
+		t.Fatalf("should clear suspicion timer")
+	}
+	if state := m.nodeMap["test3"]; state.State != stateSuspect {
+		t.Fatalf("Bad state %v", state)
+	}
+	if state := m.nodeMap["test4"]; state.State != stateDead {
+		t.Fatalf("Bad state %v", state)
+	}
+}
+
 func TestMemberlist_Gossip(t *testing.T) {
 	ch := make(chan NodeEvent, 3)
 
@@ -1772,6 +3522,173 @@ func TestMemberlist_GossipToDead(t *testing.T) {
 	})
 }
 
+func TestMemberlist_GossipDownNodes(t *testing.T) {
+	c := testConfig()
+	c.RandSeed = 1
+	m, err := NewMemberlistOnOpenPort(c)
+	if err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	defer m.Shutdown()
+	m.config.GossipToTheDeadTime = time.Hour
+
+	for _, name := range []string{"alive", "suspect", "dead", "left", "old"} {
+		a := alive{Node: name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+		m.aliveNode(&a, nil, false)
+	}
+	s := suspect{Node: "suspect", Incarnation: 1, From: "other"}
+	m.suspectNode(&s)
+	for _, name := range []string{"dead", "old"} {
+		d := dead{Node: name, Incarnation: 1, From: "other"}
+		m.deadNode(&d)
+	}
+	d := dead{Node: "left", Incarnation: 1, From: "left"}
+	m.deadNode(&d)
+	m.nodeMap["old"].StateChange = time.Now().Add(-2 * time.Hour)
+
+	// Nothing extra goes out unless it's turned on.
+	if msgs := m.downNodeStates(compoundOverhead, 1400); len(msgs) != 0 {
+		t.Fatalf("expected no messages, got %d", len(msgs))
+	}
+
+	m.config.GossipDownNodes = 10
+	got := make(map[string]string)
+	for _, msg := range m.downNodeStates(compoundOverhead, 1400) {
+		switch messageType(msg[0]) {
+		case suspectMsg:
+			var s suspect
+			if err := decode(msg[1:], &s); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			got[s.Node] = "suspect from " + s.From
+		case deadMsg:
+			var d dead
+			if err := decode(msg[1:], &d); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			got[d.Node] = "dead from " + d.From
+		default:
+			t.Fatalf("bad message type %d", msg[0])
+		}
+	}
+	expected := map[string]string{
+		"suspect": "suspect from other",
+		"dead":    "dead from other",
+		"left":    "dead from left",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("bad: %v", got)
+	}
+
+	// No more than GossipDownNodes are returned.
+	m.config.GossipDownNodes = 2
+	if msgs := m.downNodeStates(compoundOverhead, 1400); len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(msgs))
+	}
+
+	// Only what fits in the limit is returned.
+	if msgs := m.downNodeStates(compoundOverhead, 1); len(msgs) != 0 {
+		t.Fatalf("expected no messages, got %d", len(msgs))
+	}
+}
+
+func TestMemberlist_GossipFanout(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	m.config.GossipNodes = 3
+	m.config.MaxGossipNodes = 5
+
+	if fanout := m.GossipFanout(); fanout != 3 {
+		t.Fatalf("bad: %d", fanout)
+	}
+
+	cases := []struct {
+		queued int
+		fanout int
+	}{
+		{0, 3},
+		{gossipBackpressureDepth - 1, 3},
+		{gossipBackpressureDepth, 4},
+		{10 * gossipBackpressureDepth, 5},
+	}
+	for _, c := range cases {
+		m.broadcasts.Reset()
+		for i := 0; i < c.queued; i++ {
+			m.queueBroadcast(fmt.Sprintf("test%d", i), []byte("hello"), nil)
+		}
+		if fanout := m.gossipFanout(); fanout != c.fanout {
+			t.Fatalf("bad: %d queued gave %d", c.queued, fanout)
+		}
+		if fanout := m.GossipFanout(); fanout != c.fanout {
+			t.Fatalf("bad: %d", fanout)
+		}
+	}
+
+	// Without a max the fan-out is fixed.
+	m.config.MaxGossipNodes = 0
+	if fanout := m.gossipFanout(); fanout != 3 {
+		t.Fatalf("bad: %d", fanout)
+	}
+}
+
+func TestMemberlist_GossipFanout_Mult(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	m.config.GossipNodes = 3
+	m.config.GossipMult = 2
+
+	cases := []struct {
+		nodes  uint32
+		max    int
+		fanout int
+	}{
+		// GossipNodes is the floor.
+		{1, 0, 3},
+		{9, 0, 3},
+		{10, 0, 4},
+		{1000, 0, 8},
+		// MaxGossipNodes is the ceiling.
+		{1000, 6, 6},
+	}
+	for _, c := range cases {
+		atomic.StoreUint32(&m.numNodes, c.nodes)
+		m.config.MaxGossipNodes = c.max
+		if fanout := m.gossipFanout(); fanout != c.fanout {
+			t.Fatalf("bad: %d nodes gave %d", c.nodes, fanout)
+		}
+	}
+}
+
+func TestMemberlist_GossipFailures(t *testing.T) {
+	m := &Memberlist{
+		config:          &Config{ProbeInterval: 20 * time.Millisecond},
+		gossipFailTimes: make(map[string]time.Time),
+	}
+
+	m.recordGossipSend("fail", fmt.Errorf("nope"))
+	m.recordGossipSend("ok", nil)
+	failed := m.gossipFailures()
+	if _, ok := failed["fail"]; !ok || len(failed) != 1 {
+		t.Fatalf("bad: %v", failed)
+	}
+
+	// A successful send clears the failure right away.
+	m.recordGossipSend("fail", nil)
+	if failed := m.gossipFailures(); len(failed) != 0 {
+		t.Fatalf("bad: %v", failed)
+	}
+
+	// Otherwise it's forgotten after a probe interval.
+	m.recordGossipSend("fail", fmt.Errorf("nope"))
+	time.Sleep(30 * time.Millisecond)
+	if failed := m.gossipFailures(); len(failed) != 0 {
+		t.Fatalf("bad: %v", failed)
+	}
+	if len(m.gossipFailTimes) != 0 {
+		t.Fatalf("bad: %v", m.gossipFailTimes)
+	}
+}
+
 func TestMemberlist_PushPull(t *testing.T) {
 	addr1 := getBindAddr()
 	addr2 := getBindAddr()
@@ -1809,6 +3726,76 @@ func TestMemberlist_PushPull(t *testing.T) {
 	})
 }
 
+func TestMemberlist_PushPull_Exclude(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	ip1 := []byte(addr1)
+	ip2 := []byte(addr2)
+
+	ch := make(chan NodeEvent, 3)
+
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.GossipInterval = 10 * time.Second
+		c.PushPullInterval = time.Millisecond
+		c.PushPullExcludeFunc = func(n *Node) bool {
+			return n.Name == addr2.String()
+		}
+	})
+	m2 := HostMemberlist(addr2.String(), t, func(c *Config) {
+		c.GossipInterval = 10 * time.Second
+		c.Events = &ChannelEventDelegate{ch}
+	})
+
+	defer m1.Shutdown()
+	defer m2.Shutdown()
+
+	a1 := alive{Node: addr1.String(), Addr: ip1, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a1, nil, true)
+	a2 := alive{Node: addr2.String(), Addr: ip2, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a2, nil, false)
+
+	// m2 is the only candidate, so nothing should ever be exchanged.
+	for i := 0; i < 5; i++ {
+		m1.pushPull()
+	}
+	time.Sleep(10 * time.Millisecond)
+	if len(ch) != 0 {
+		t.Fatalf("expected no push/pull with an excluded node, got %d events", len(ch))
+	}
+}
+
+func TestMemberlist_PushPull_RoundRobin(t *testing.T) {
+	m := &Memberlist{config: &Config{Name: "self", RoundRobinPushPull: true}}
+	m.nodes = []*nodeState{
+		&nodeState{Node: Node{Name: "a"}, State: stateAlive},
+		&nodeState{Node: Node{Name: "self"}, State: stateAlive},
+		&nodeState{Node: Node{Name: "b"}, State: stateDead},
+		&nodeState{Node: Node{Name: "c"}, State: stateAlive},
+	}
+	filterFn := func(n *nodeState) bool {
+		return n.Name == m.config.Name || n.State != stateAlive
+	}
+
+	// Every eligible node should come up in turn.
+	var picked []string
+	for i := 0; i < 4; i++ {
+		nodes := m.nextPushPullNode(filterFn)
+		if len(nodes) != 1 {
+			t.Fatalf("bad: %v", nodes)
+		}
+		picked = append(picked, nodes[0].Name)
+	}
+	if !reflect.DeepEqual(picked, []string{"a", "c", "a", "c"}) {
+		t.Fatalf("bad: %v", picked)
+	}
+
+	// With nothing eligible we should give up rather than spin.
+	m.nodes = m.nodes[1:3]
+	if nodes := m.nextPushPullNode(filterFn); len(nodes) != 0 {
+		t.Fatalf("bad: %v", nodes)
+	}
+}
+
 func TestVerifyProtocol(t *testing.T) {
 	cases := []struct {
 		Anodes   [][3]uint8
@@ -1930,3 +3917,51 @@ func testVerifyProtocolSingle(t *testing.T, A [][6]uint8, B [][6]uint8, expect b
 		t.Fatalf("bad:\nA: %v\nB: %v\nErr: %s", A, B, err)
 	}
 }
+
+func TestMemberList_Schedule_PushPullOnly(t *testing.T) {
+	addr1 := getBindAddr()
+	m := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeInterval = 0
+		c.GossipInterval = 0
+		c.PushPullInterval = time.Hour
+	})
+	defer m.Shutdown()
+
+	base := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		m.schedule()
+		stopCh := m.stopTick
+		if stopCh == nil {
+			t.Fatalf("expected stop channel after schedule")
+		}
+		if len(m.tickers) != 0 {
+			t.Fatalf("expected no tickers, got %d", len(m.tickers))
+		}
+
+		// A second schedule should be a no-op.
+		m.schedule()
+		if m.stopTick != stopCh {
+			t.Fatalf("expected schedule to be idempotent")
+		}
+
+		m.deschedule()
+		if m.stopTick != nil {
+			t.Fatalf("expected stop channel to be cleared")
+		}
+		select {
+		case <-stopCh:
+		default:
+			t.Fatalf("expected stop channel to be closed")
+		}
+
+		// A second deschedule should be a no-op.
+		m.deschedule()
+	}
+
+	// The push/pull goroutines should all have exited.
+	retry(t, 50, 10*time.Millisecond, func(failf func(string, ...interface{})) {
+		if n := runtime.NumGoroutine(); n > base {
+			failf("goroutines leaked: %d > %d", n, base)
+		}
+	})
+}
@@ -0,0 +1,55 @@
+package memberlist
+
+// subscriberBuffer is the number of events that can be queued up for a
+// subscriber before we start dropping them.
+const subscriberBuffer = 64
+
+// Subscribe registers a new subscriber for membership events, and returns an
+// ID that can be passed to Unsubscribe along with the channel the events will
+// be delivered on. This can be called any number of times, and unlike with a
+// ChannelEventDelegate, each subscriber gets its own buffered channel. If a
+// subscriber falls too far behind then events for it will be dropped rather
+// than holding up memberlist or any of the other subscribers.
+//
+// The nodes given in the events are copies, so they are safe to hold on to.
+func (m *Memberlist) Subscribe() (int, <-chan NodeEvent) {
+	m.subscribersLock.Lock()
+	defer m.subscribersLock.Unlock()
+
+	m.nextSubscriberID++
+	id := m.nextSubscriberID
+	ch := make(chan NodeEvent, subscriberBuffer)
+	m.subscribers[id] = ch
+	return id, ch
+}
+
+// Unsubscribe removes the subscriber with the given ID and closes its channel.
+// This is a no-op if there's no such subscriber.
+func (m *Memberlist) Unsubscribe(id int) {
+	m.subscribersLock.Lock()
+	defer m.subscribersLock.Unlock()
+
+	if ch, ok := m.subscribers[id]; ok {
+		close(ch)
+		delete(m.subscribers, id)
+	}
+}
+
+// publish sends an event about the given node to all the subscribers.
+func (m *Memberlist) publish(event NodeEventType, node *Node) {
+	m.subscribersLock.Lock()
+	defer m.subscribersLock.Unlock()
+
+	if len(m.subscribers) == 0 {
+		return
+	}
+
+	n := *node
+	for _, ch := range m.subscribers {
+		select {
+		case ch <- NodeEvent{event, &n}:
+		default:
+			m.metricSink().IncrCounter([]string{"memberlist", "subscriber", "dropped"}, 1)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package memberlist
+
+import (
+	"testing"
+)
+
+func TestMemberlist_Subscribe(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	// Fill up the first subscriber so it starts dropping events.
+	id1, ch1 := m.Subscribe()
+	for i := 0; i < subscriberBuffer; i++ {
+		m.publish(NodeUpdate, &Node{Name: "filler"})
+	}
+
+	id2, ch2 := m.Subscribe()
+	if id1 == id2 {
+		t.Fatalf("bad: %d %d", id1, id2)
+	}
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1}
+	m.aliveNode(&a, nil, false)
+
+	// The second subscriber should be unaffected by the first one.
+	select {
+	case e := <-ch2:
+		if e.Event != NodeJoin || e.Node.Name != "test" {
+			t.Fatalf("bad: %#v", e)
+		}
+	default:
+		t.Fatalf("should have gotten a join")
+	}
+	for i := 0; i < subscriberBuffer; i++ {
+		if e := <-ch1; e.Node.Name != "filler" {
+			t.Fatalf("bad: %#v", e)
+		}
+	}
+
+	// Once unsubscribed, the channel should be closed and no longer fed.
+	m.Unsubscribe(id1)
+	if _, ok := <-ch1; ok {
+		t.Fatalf("should be closed")
+	}
+	m.Unsubscribe(id1)
+
+	d := dead{Node: "test", From: "test", Incarnation: 1}
+	m.deadNode(&d)
+	select {
+	case e := <-ch2:
+		if e.Event != NodeLeave || e.Node.Name != "test" {
+			t.Fatalf("bad: %#v", e)
+		}
+	default:
+		t.Fatalf("should have gotten a leave")
+	}
+}
@@ -9,8 +9,10 @@ import (
 	"math"
 	"math/rand"
 	"net"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/go-msgpack/codec"
@@ -51,12 +53,39 @@ func encode(msgType messageType, in interface{}) (*bytes.Buffer, error) {
 	return buf, err
 }
 
+// lockedSource is a rand.Source that's safe for concurrent use.
+type lockedSource struct {
+	sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.Lock()
+	defer s.Unlock()
+	s.src.Seed(seed)
+}
+
+// newRand returns a random number generator that's safe for concurrent use,
+// seeded with the given seed, or with a random one if that's zero.
+func newRand(seed int64) *rand.Rand {
+	if seed == 0 {
+		seed = rand.Int63()
+	}
+	return rand.New(&lockedSource{src: rand.NewSource(seed)})
+}
+
 // Returns a random offset between 0 and n
-func randomOffset(n int) int {
+func randomOffset(r *rand.Rand, n int) int {
 	if n == 0 {
 		return 0
 	}
-	return int(rand.Uint32() % uint32(n))
+	return int(r.Uint32() % uint32(n))
 }
 
 // suspicionTimeout computes the timeout that should be used when
@@ -75,11 +104,21 @@ func retransmitLimit(retransmitMult, n int) int {
 	return limit
 }
 
+// generateName returns the hostname with a random suffix, for use as a node
+// name when none is configured.
+func generateName() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "memberlist"
+	}
+	return fmt.Sprintf("%s-%08x", hostname, rand.Uint32())
+}
+
 // shuffleNodes randomly shuffles the input nodes using the Fisher-Yates shuffle
-func shuffleNodes(nodes []*nodeState) {
+func shuffleNodes(r *rand.Rand, nodes []*nodeState) {
 	n := len(nodes)
 	for i := n - 1; i > 0; i-- {
-		j := rand.Intn(i + 1)
+		j := r.Intn(i + 1)
 		nodes[i], nodes[j] = nodes[j], nodes[i]
 	}
 }
@@ -123,7 +162,7 @@ func moveDeadNodes(nodes []*nodeState, gossipToTheDeadTime time.Duration) int {
 // kRandomNodes is used to select up to k random nodes, excluding any nodes where
 // the filter function returns true. It is possible that less than k nodes are
 // returned.
-func kRandomNodes(k int, nodes []*nodeState, filterFn func(*nodeState) bool) []*nodeState {
+func kRandomNodes(r *rand.Rand, k int, nodes []*nodeState, filterFn func(*nodeState) bool) []*nodeState {
 	n := len(nodes)
 	kNodes := make([]*nodeState, 0, k)
 OUTER:
@@ -132,7 +171,7 @@ OUTER:
 	// exhaustive
 	for i := 0; i < 3*n && len(kNodes) < k; i++ {
 		// Get random node
-		idx := randomOffset(n)
+		idx := randomOffset(r, n)
 		node := nodes[idx]
 
 		// Give the filter a shot at it.
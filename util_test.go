@@ -51,9 +51,10 @@ func TestEncodeDecode(t *testing.T) {
 }
 
 func TestRandomOffset(t *testing.T) {
+	r := newRand(0)
 	vals := make(map[int]struct{})
 	for i := 0; i < 100; i++ {
-		offset := randomOffset(2 << 30)
+		offset := randomOffset(r, 2<<30)
 		if _, ok := vals[offset]; ok {
 			t.Fatalf("got collision")
 		}
@@ -62,7 +63,7 @@ func TestRandomOffset(t *testing.T) {
 }
 
 func TestRandomOffset_Zero(t *testing.T) {
-	offset := randomOffset(0)
+	offset := randomOffset(newRand(0), 0)
 	if offset != 0 {
 		t.Fatalf("bad offset")
 	}
@@ -134,7 +135,7 @@ func TestShuffleNodes(t *testing.T) {
 		t.Fatalf("should match")
 	}
 
-	shuffleNodes(nodes)
+	shuffleNodes(newRand(0), nodes)
 
 	if reflect.DeepEqual(nodes, orig) {
 		t.Fatalf("should not match")
@@ -243,9 +244,10 @@ func TestKRandomNodes(t *testing.T) {
 		return false
 	}
 
-	s1 := kRandomNodes(3, nodes, filterFunc)
-	s2 := kRandomNodes(3, nodes, filterFunc)
-	s3 := kRandomNodes(3, nodes, filterFunc)
+	r := newRand(0)
+	s1 := kRandomNodes(r, 3, nodes, filterFunc)
+	s2 := kRandomNodes(r, 3, nodes, filterFunc)
+	s3 := kRandomNodes(r, 3, nodes, filterFunc)
 
 	if reflect.DeepEqual(s1, s2) {
 		t.Fatalf("unexpected equal")